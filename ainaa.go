@@ -2,27 +2,106 @@ package ainaa
 
 import (
 	"context"
-	"net"
-	"os"
-	"strconv"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
 const (
-	tableName = "AinaaDomains"
-	name      = "ainaa"
-	cacheTTL  = 1 * time.Hour
+	name = "ainaa"
+
+	defaultTableName   = "AinaaDomains"
+	defaultRedisAddr   = "localhost:6379"
+	defaultCacheTTL    = 1 * time.Hour
+	defaultBlockStatus = 1
+
+	// defaultTimeout bounds the time spent on a query, across the cache,
+	// DynamoDB and every upstream server tried.
+	defaultTimeout = 5 * time.Second
+
+	// answerTTL is the TTL of records synthesized by the plugin.
+	answerTTL = 300
+	// profileRefresh is how often profiles stored in DynamoDB are reloaded.
+	profileRefresh = 1 * time.Minute
 )
 
+var defaultResolvers = []string{
+	"208.67.222.222:53", // OpenDNS primary
+	"208.67.220.220:53", // OpenDNS secondary
+}
+
 type Ainaa struct {
 	Next       plugin.Handler
 	Cache      CacheRepository
 	Persistent PersistentRepository
 	Resolver   Resolver
+	// Classifier decides whether domains missing from the cache and the
+	// persistent store are blocked. Without it, the resolver's answers are
+	// checked against the OpenDNS block pages.
+	Classifier Classifier
+
+	// BlockStatus is the status recorded for domains the resolver flags as blocked.
+	BlockStatus int
+	// CacheTTL is how long decisions are kept in the cache.
+	CacheTTL time.Duration
+	// StaleWindow is how long decisions and addresses are still served once
+	// expired, while they are refreshed in the background; zero disables
+	// serving stale data.
+	StaleWindow time.Duration
+	// Prefetch refreshes popular entries before they expire.
+	Prefetch Prefetch
+	// NegativeTTL is the longest domains that do not exist, or have no
+	// addresses, are cached; zero disables caching them.
+	NegativeTTL time.Duration
+	// ServfailTTL is how long domains whose lookup failed are cached; zero
+	// disables caching them.
+	ServfailTTL time.Duration
+	// Timeout bounds the lookups made for a query that has no deadline yet;
+	// zero means no limit.
+	Timeout time.Duration
+	// FilterOnly makes the plugin only decide whether a domain is blocked;
+	// queries for allowed domains are passed unchanged to the next plugin.
+	FilterOnly bool
+	// Allowlist holds domains that are never blocked, whatever their status.
+	Allowlist DomainList
+	// BlockResponse is how blocked domains are answered, unless their
+	// category has a response of its own.
+	BlockResponse BlockResponse
+	// Categories maps statuses to their category and action.
+	Categories map[int]Category
+	// Profiles selects per-client rules by client ID or source address.
+	Profiles *Profiles
+	// ClientIdentifiers are tried in order to find the ID of a client.
+	ClientIdentifiers []ClientIdentifier
+	// BlockEDE is the Extended DNS Error code (RFC 8914) attached to blocked
+	// responses; zero disables it.
+	BlockEDE uint16
+	// Degraded is how domains nobody knows yet are answered while every
+	// upstream is down.
+	Degraded DegradedMode
+	// IPBlocklist holds the address ranges allowed domains must not resolve to.
+	IPBlocklist PrefixList
+	// IPAction is what is done with answers holding addresses of IPBlocklist.
+	IPAction IPAction
+
+	// lastKnown remembers recent classifications for DegradedStale.
+	lastKnown *lastKnown
+	// lookups and resolutions coalesce the concurrent lookups made for a
+	// domain; nil runs each on its own.
+	lookups     *flightGroup[verdict]
+	resolutions *flightGroup[Resolution]
+	// refreshes runs one background refresh of stale data at a time per key.
+	refreshes *flightGroup[struct{}]
+	// hits counts the cache hits of every domain for Prefetch.
+	hits *hitCounter
+	// now returns the time schedules are evaluated at, time.Now if nil.
+	now func() time.Time
 }
 
 var openDNSBlockedIPs = []string{
@@ -31,168 +110,518 @@ var openDNSBlockedIPs = []string{
 	"::ffff:146.112.61.104",
 	"::ffff:9270:3d6a",
 }
-var blockedIPs = map[string][]string{
-	"A":    {"0.0.0.0"},
-	"AAAA": {"::"},
-}
 
 func (a Ainaa) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	domain := r.Question[0].Name
+	domain := strings.ToLower(r.Question[0].Name)
 	domain = domain[:len(domain)-1] // Remove trailing dot
 
 	log.Debugf("Received query for domain: %s", domain)
-
-	// 1. Check Cache
-	if cachedVal, err := a.Cache.Get(ctx, domain); err == nil {
-		return a.handleCacheHit(w, r, domain, cachedVal)
+	if domain == "" {
+		return plugin.NextOrFailure(a.Name(), a.Next, ctx, w, r)
 	}
 
-	// 2. Check Persistent Storage
-	log.Debugf("Cache miss for domain: %s, looking up in Persistent Storage", domain)
-	if domainRecord, err := a.Persistent.Get(ctx, domain); err == nil {
-		return a.handlePersistentHit(ctx, w, r, domain, domainRecord)
+	if _, ok := ctx.Deadline(); !ok && a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
 	}
 
-	// 3. Handle Miss (Fresh Lookup)
-	log.Debugf("Domain %s not found in Persistent Storage, performing fresh lookup", domain)
-	return a.handleMiss(ctx, w, r, domain)
-}
+	now := a.clock()
+	client := a.identify(ctx, request.Request{W: w, Req: r})
+	profile := a.Profiles.Match(client, now)
+	setClientMetadata(ctx, client, profile)
 
-func (a Ainaa) handleCacheHit(w dns.ResponseWriter, r *dns.Msg, domain string, cachedVal CachedDomain) (int, error) {
-	log.Debugf("Cache hit for domain: %s with status: %d", domain, cachedVal.Status)
-	if cachedVal.Status != 0 {
-		log.Debugf("Domain %s is blocked with status: %d", domain, cachedVal.Status)
-		resp := buildResponse(r, dns.RcodeNameError, blockedIPs)
-		w.WriteMsg(resp)
-		return dns.RcodeNameError, nil
+	v, err := a.decide(ctx, domain, profile)
+	if err == nil {
+		// Domains that did not exist or could not be looked up moments ago
+		// are answered the same, without asking the upstream again.
+		err = v.failure(now)
+	}
+	if notFound(err) && a.FilterOnly {
+		// Names only the next plugin knows, such as those of a split
+		// horizon, are not blocked for being unknown to the upstream.
+		log.Debugf("Domain %s is unknown upstream, passing it to the next plugin", domain)
+		countQuery(ctx, client, profile, ActionAllow.String())
+		return plugin.NextOrFailure(a.Name(), a.Next, ctx, w, r)
+	}
+	if notFound(err) {
+		countQuery(ctx, client, profile, "nxdomain")
+		return a.serveNotFound(w, r, domain, err)
+	}
+	if err != nil {
+		countQuery(ctx, client, profile, "error")
+		return a.serveFailure(w, r, domain, err)
 	}
 
-	log.Debugf("Cache hit for domain: %s with IPs: %v", domain, cachedVal.IPs)
-	if cachedVal.IPs != nil {
-		log.Debugf("Serving cached IPs for domain: %s", domain)
-		resp := buildResponse(r, dns.RcodeSuccess, cachedVal.IPs)
-		w.WriteMsg(resp)
-		return dns.RcodeSuccess, nil
+	cat := a.categoryFor(v, profile, now)
+	var res *Resolution
+	if cat.Action == ActionAllow || cat.Action == ActionLog {
+		if !a.FilterOnly && answersAddresses(r) {
+			resolution, err := a.resolution(ctx, domain, v, now)
+			if err != nil {
+				countQuery(ctx, client, profile, "error")
+				return a.serveFailure(w, r, domain, err)
+			}
+			res = &resolution
+			v.cnames = resolution.chain()
+		}
+		if av, acat, ok := a.uncloak(ctx, v, profile, now); ok {
+			log.Debugf("Domain %s is an alias of %s", domain, av.zone)
+			v, cat = av, acat
+		} else if res != nil && v.source != sourceAllowlist {
+			if bv, ok := a.filterAddresses(domain, res); ok {
+				v, cat = bv, a.categoryFor(bv, profile, now)
+			}
+		}
+	}
+	setMetadata(ctx, v)
+	setCategoryMetadata(ctx, cat)
+	countQuery(ctx, client, profile, cat.Action.String())
+	switch cat.Action {
+	case ActionBlock:
+		log.Debugf("Domain %s is blocked for %s as %s by %s (%s)", domain, client, a.describe(v), v.source, v.zone)
+		return a.serveBlocked(w, r, v, cat, profile)
+	case ActionRedirect:
+		log.Debugf("Domain %s is redirected for %s as %s by %s (%s)", domain, client, a.describe(v), v.source, v.zone)
+		return a.serveRedirect(ctx, w, r, domain, cat)
+	case ActionLog:
+		log.Infof("Domain %s matched %s by %s (%s) for %s, allowing", domain, a.describe(v), v.source, v.zone, client)
+	default:
+		log.Debugf("Domain %s is allowed for %s by %s (%s)", domain, client, v.source, v.zone)
 	}
+	return a.serveAllowed(ctx, w, r, domain, res)
+}
 
-	log.Debugf("No IPs cached for domain: %s, performing fresh lookup", domain)
-	ips, err := a.Resolver.Lookup(domain)
-	if err != nil {
-		log.Errorf("Error looking up domain %s: %v", domain, err)
-		return dns.RcodeServerFailure, err
+// decide determines whether domain is blocked for clients of profile.
+func (a Ainaa) decide(ctx context.Context, domain string, profile *Profile) (verdict, error) {
+	// 1. Check the lists of the client's profile, then the Allowlist
+	if zone, denied, ok := profile.matchLists(domain); ok {
+		if denied {
+			return verdict{zone: zone, denied: true, source: sourceDenylist}, nil
+		}
+		return verdict{zone: zone, source: sourceAllowlist}, nil
 	}
-	resp := buildResponse(r, dns.RcodeSuccess, ips)
-	w.WriteMsg(resp)
-	return dns.RcodeSuccess, nil
+	if zone, ok := a.Allowlist.Match(domain); ok {
+		return verdict{zone: zone, source: sourceAllowlist}, nil
+	}
+
+	// 2. and 3. are shared by the concurrent queries for domain, so a domain
+	// many clients ask for at once is looked up once.
+	return a.lookups.do(ctx, domain, func(ctx context.Context) (verdict, error) {
+		return a.lookup(ctx, domain)
+	})
 }
 
-func (a Ainaa) handlePersistentHit(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string, domainRecord DomainRecord) (int, error) {
-	log.Debugf("Domain %s found in Persistent Storage with status: %d", domain, domainRecord.Status)
+// lookup decides on domain from the records stored for it and its parents,
+// or else by classifying it.
+func (a Ainaa) lookup(ctx context.Context, domain string) (verdict, error) {
+	// 2. Walk from the queried name up to its TLD; the most specific record
+	// wins, unless a record further up explicitly allows the domain or the
+	// record found was only written after a classification lookup.
+	var found *verdict
+	for _, zone := range domainAndParents(domain) {
+		rec, ok, err := a.lookupZone(ctx, domain, zone)
+		if err != nil {
+			// Deciding without the record would risk ignoring a block, and
+			// the resolver's verdict would be saved over it.
+			return verdict{}, err
+		}
+		if !ok || !inherits(domain, zone, rec) {
+			continue
+		}
+		v := newVerdict(domain, zone, rec)
+		v.stale = a.isStale(rec)
+		if rec.Allow {
+			log.Debugf("Domain %s is explicitly allowed on %s", domain, zone)
+			if found != nil {
+				v.ips, v.cnames, v.expires, v.negative = found.ips, found.cnames, found.expires, found.negative
+				v.stale = v.stale || found.stale
+			}
+			v.status = 0
+			return v, nil
+		}
+		switch {
+		case found == nil:
+			found = &v
+		case found.source == sourceResolver:
+			// A classification lookup only vouches for the name it looked
+			// up, a block stored for a parent overrides it.
+			if !found.failed() {
+				v.ips, v.cnames, v.expires, v.negative = found.ips, found.cnames, found.expires, found.negative
+			}
+			v.stale = v.stale || found.stale
+			found = &v
+		}
+		if found.status == 0 && found.source != sourceResolver {
+			return *found, nil
+		}
+	}
+	if found != nil {
+		return *found, nil
+	}
 
-	if domainRecord.Status != 0 {
-		// Update Cache with blocked status
-		a.Cache.Set(ctx, domain, CachedDomain{Status: domainRecord.Status, IPs: nil}, cacheTTL)
-		log.Debugf("Domain %s is blocked with status: %d", domain, domainRecord.Status)
-		resp := buildResponse(r, dns.RcodeNameError, blockedIPs)
-		w.WriteMsg(resp)
-		return dns.RcodeNameError, nil
+	// The walk may have missed because the query was cancelled or timed out,
+	// don't mistake that for a domain nobody knows.
+	if err := ctx.Err(); err != nil {
+		return verdict{}, err
 	}
 
-	if domainRecord.IPs != nil {
-		// Update Cache with IPs
-		a.Cache.Set(ctx, domain, CachedDomain{Status: domainRecord.Status, IPs: domainRecord.IPs}, cacheTTL)
-		log.Debugf("Serving Persistent Storage IPs for domain: %s", domain)
-		resp := buildResponse(r, dns.RcodeSuccess, domainRecord.IPs)
-		w.WriteMsg(resp)
-		return dns.RcodeSuccess, nil
+	// 3. Handle Miss (Fresh Lookup)
+	log.Debugf("Domain %s not found in Persistent Storage, performing fresh lookup", domain)
+	return a.handleMiss(ctx, domain)
+}
+
+// lookupZone returns the record stored for zone, from the cache or else from
+// persistent storage, while walking up from the queried domain. It fails if
+// persistent storage cannot tell whether zone has a record.
+func (a Ainaa) lookupZone(ctx context.Context, domain, zone string) (CachedDomain, bool, error) {
+	// Check Cache
+	if cachedVal, err := a.Cache.Get(ctx, zone); err == nil && !a.failureExpired(cachedVal) {
+		log.Debugf("Cache hit for domain: %s with status: %d", zone, cachedVal.Status)
+		if a.isStale(cachedVal) {
+			log.Debugf("Serving stale record of domain %s while refreshing it", zone)
+			a.refresh("zone "+zone, func(ctx context.Context) error {
+				return a.refreshZone(ctx, zone, cachedVal)
+			})
+		} else if zone == domain && a.popular(zone, cachedVal) {
+			// Only the queried domain counts, not the parents every walk
+			// passes through.
+			a.refresh("prefetch "+zone, func(ctx context.Context) error {
+				return a.prefetch(ctx, zone, cachedVal)
+			})
+		}
+		if cachedVal.Absent {
+			return CachedDomain{}, false, nil
+		}
+		return cachedVal, true, nil
 	}
 
-	log.Debugf("Performing fresh lookup for domain: %s", domain)
-	ips, err := a.Resolver.Lookup(domain)
+	// Check Persistent Storage
+	log.Debugf("Cache miss for domain: %s, looking up in Persistent Storage", zone)
+	domainRecord, err := a.Persistent.Get(ctx, zone)
+	if errors.Is(err, ErrDomainNotFound) {
+		// Remember the zone has no record, or every walk through it, such
+		// as each query for a blocked subdomain, would ask DynamoDB again.
+		a.store(ctx, zone, CachedDomain{Absent: true})
+		return CachedDomain{}, false, nil
+	}
 	if err != nil {
-		log.Errorf("Error looking up domain %s: %v", domain, err)
-		return dns.RcodeServerFailure, err
+		return CachedDomain{}, false, err
 	}
+	log.Debugf("Domain %s found in Persistent Storage with status: %d", zone, domainRecord.Status)
 
-	// Update Cache with status only (no IPs)
-	a.Cache.Set(ctx, domain, CachedDomain{Status: domainRecord.Status, IPs: nil}, cacheTTL)
+	// Cache the record under its own name so other subdomains find it too.
+	cachedVal := cachedRecord(domainRecord)
+	a.store(ctx, zone, cachedVal)
+	return cachedVal, true, nil
+}
 
-	resp := buildResponse(r, dns.RcodeSuccess, ips)
-	w.WriteMsg(resp)
+// cachedRecord returns the cache entry of a record stored in DynamoDB.
+func cachedRecord(domainRecord DomainRecord) CachedDomain {
+	return CachedDomain{
+		Status:    domainRecord.Status,
+		IPs:       domainRecord.IPs,
+		NoInherit: domainRecord.NoInherit,
+		Allow:     domainRecord.Allow,
+		Source:    domainRecord.Source,
+	}
+}
 
-	return dns.RcodeSuccess, nil
+// store caches rec for zone. It is fresh for CacheTTL and kept for
+// StaleWindow after that.
+func (a Ainaa) store(ctx context.Context, zone string, rec CachedDomain) {
+	rec.Expires = a.clock().Add(a.CacheTTL).Unix()
+	a.Cache.Set(ctx, zone, rec, a.CacheTTL+a.StaleWindow)
 }
 
-func (a Ainaa) handleMiss(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string) (int, error) {
-	ips, err := a.Resolver.Lookup(domain)
+func (a Ainaa) handleMiss(ctx context.Context, domain string) (verdict, error) {
+	res, err := a.classify(ctx, domain)
+	if errors.Is(err, ErrUpstreamsDown) {
+		return a.degrade(domain, err)
+	}
 	if err != nil {
-		log.Errorf("Error looking up domain %s: %v", domain, err)
-		return dns.RcodeServerFailure, err
+		a.storeFailure(ctx, domain, err)
+		return verdict{}, err
 	}
 
+	// The resolver only vouches for the exact name it looked up, so its
+	// verdict must not be inherited by subdomains.
 	newDomainRec := DomainRecord{
 		Domain:    domain,
 		CreatedAt: time.Now().UTC(),
+		NoInherit: true,
+		Source:    sourceResolver,
+		Verdicts:  res.Verdicts,
 	}
-	newCachedRec := CachedDomain{}
+	newCachedRec := CachedDomain{NoInherit: true, Source: sourceResolver}
 
-	isBlocked := false
+	if res.Blocked {
+		log.Debugf("Domain %s is blocked based on resolver lookup", domain)
+		newDomainRec.Status = a.BlockStatus
+		newCachedRec.Status = a.BlockStatus
+	} else {
+		log.Debugf("Domain %s is allowed, storing in database and cache", domain)
+	}
+	v := verdict{zone: domain, status: newDomainRec.Status, ips: res.IPs, cnames: res.CNAMEs, source: sourceResolver}
+	if !res.Blocked && len(res.IPs) == 0 && a.NegativeTTL > 0 {
+		// NODATA: the domain exists without addresses.
+		v.expires = a.clock().Add(a.negativeTTL(res.TTL))
+		v.negative = negativeNoData
+		newCachedRec.IPs, newCachedRec.CNAMEs = map[string][]string{}, res.CNAMEs
+		newCachedRec.IPsExpire, newCachedRec.Negative = v.expires.Unix(), negativeNoData
+	} else if res.TTL > 0 {
+		// Keep the addresses as long as the upstream said they are valid.
+		v.expires = a.clock().Add(time.Duration(res.TTL) * time.Second)
+		if !res.Blocked {
+			newCachedRec.IPs, newCachedRec.CNAMEs = res.IPs, res.CNAMEs
+			newCachedRec.IPsExpire = v.expires.Unix()
+		}
+	}
+	if res.Partial {
+		// Some classifiers failed, the domain is classified again once the
+		// cache entry expires rather than stored for good.
+		log.Debugf("Domain %s was classified by part of the classifiers, not storing it", domain)
+	} else {
+		a.Persistent.Save(ctx, newDomainRec)
+	}
+	a.store(ctx, domain, newCachedRec)
+	newCachedRec.IPs, newCachedRec.CNAMEs = res.IPs, res.CNAMEs
+	a.lastKnown.set(domain, newCachedRec)
+
+	return v, nil
+}
+
+// degrade decides on domain while no upstream can classify it. Nothing is
+// stored, so the domain is classified again once an upstream is back.
+func (a Ainaa) degrade(domain string, err error) (verdict, error) {
+	switch a.Degraded {
+	case DegradedAllow:
+		log.Debugf("Upstreams are down, allowing domain %s", domain)
+		return verdict{zone: domain, source: sourceDegraded}, nil
+	case DegradedBlock:
+		log.Debugf("Upstreams are down, blocking domain %s", domain)
+		return verdict{zone: domain, status: a.BlockStatus, source: sourceDegraded}, nil
+	}
+	rec, ok := a.lastKnown.get(domain)
+	if !ok {
+		return verdict{}, err
+	}
+	log.Debugf("Upstreams are down, serving the last known status %d of domain %s", rec.Status, domain)
+	v := newVerdict(domain, domain, rec)
+	// The upstreams cannot give fresher addresses.
+	v.expires = time.Time{}
+	v.source = sourceDegraded
+	return v, nil
+}
+
+// classify asks the classifier whether domain is blocked, or else looks it up
+// through the resolver and checks its addresses.
+func (a Ainaa) classify(ctx context.Context, domain string) (Classification, error) {
+	if a.Classifier != nil {
+		return a.Classifier.Classify(ctx, domain)
+	}
+	resolution, err := a.resolve(ctx, domain)
+	if err != nil {
+		return Classification{}, err
+	}
+	if resolution.Rcode == dns.RcodeNameError {
+		return Classification{}, errNotFound(domain, "", resolution.TTL())
+	}
+	res := Classification{IPs: resolution.IPs(), CNAMEs: resolution.chain(), TTL: resolution.TTL()}
 	if resolver, ok := a.Resolver.(interface {
 		IsBlockedDomain(map[string][]string) bool
 	}); ok {
-		isBlocked = resolver.IsBlockedDomain(ips)
+		res.Blocked = resolver.IsBlockedDomain(res.IPs)
 	}
+	return res, nil
+}
 
-	if isBlocked {
-		log.Debugf("Domain %s is blocked based on resolver lookup", domain)
-		envStatus, _ := strconv.Atoi(os.Getenv("STATUS"))
-		newDomainRec.Status = envStatus
-		newCachedRec.Status = envStatus
-		a.Persistent.Save(ctx, newDomainRec)
-		a.Cache.Set(ctx, domain, newCachedRec, cacheTTL)
-		resp := buildResponse(r, dns.RcodeNameError, blockedIPs)
-		w.WriteMsg(resp)
-		return dns.RcodeNameError, nil
+// resolve looks up the addresses of domain, keeping the records as the
+// upstream sent them when the resolver can. A domain that does not exist is
+// an answer, not an error.
+func (a Ainaa) resolve(ctx context.Context, domain string) (Resolution, error) {
+	if resolver, ok := a.Resolver.(interface {
+		Resolve(context.Context, string) (Resolution, error)
+	}); ok {
+		return resolver.Resolve(ctx, domain)
+	}
+	ips, err := a.Resolver.Lookup(ctx, domain)
+	if notFound(err) {
+		return Resolution{Rcode: dns.RcodeNameError}, nil
+	}
+	if err != nil {
+		return Resolution{}, err
+	}
+	return resolutionOf(domain, nil, ips, answerTTL), nil
+}
+
+// resolution returns the records of domain, rebuilt from the addresses known
+// to v while they are valid or else looked up afresh.
+func (a Ainaa) resolution(ctx context.Context, domain string, v verdict, now time.Time) (Resolution, error) {
+	if ips, ttl := v.addresses(now); ips != nil {
+		if v.stale {
+			ttl = min(ttl, staleTTL)
+		}
+		return resolutionOf(domain, v.cnames, ips, ttl), nil
 	}
+	if v.ips != nil && a.StaleWindow > 0 && now.Before(v.expires.Add(a.StaleWindow)) {
+		log.Debugf("Serving stale addresses of domain %s while refreshing them", domain)
+		a.refresh("addresses "+domain, func(ctx context.Context) error {
+			return a.refreshAddresses(ctx, domain)
+		})
+		return resolutionOf(domain, v.cnames, v.ips, staleTTL), nil
+	}
+	log.Debugf("No IPs known for domain: %s, performing fresh lookup", domain)
+	return a.resolutions.do(ctx, domain, func(ctx context.Context) (Resolution, error) {
+		return a.resolve(ctx, domain)
+	})
+}
+
+// uncloak checks the names the domain of v is an alias of, so a tracker
+// hidden behind a harmless-looking CNAME is blocked as if it had been
+// queried. It returns the verdict and category of the first alias blocked for
+// clients of profile. Domains on an allowlist are not checked.
+func (a Ainaa) uncloak(ctx context.Context, v verdict, profile *Profile, now time.Time) (verdict, Category, bool) {
+	if v.source == sourceAllowlist {
+		return verdict{}, Category{}, false
+	}
+	for _, alias := range v.cnames {
+		av, err := a.decide(ctx, alias, profile)
+		if err != nil {
+			log.Debugf("Cannot check alias %s: %v", alias, err)
+			continue
+		}
+		if cat := a.categoryFor(av, profile, now); cat.Action == ActionBlock {
+			return av, cat, true
+		}
+	}
+	return verdict{}, Category{}, false
+}
 
-	log.Debugf("Domain %s is allowed, storing in database and cache", domain)
-	newDomainRec.Status = 0
-	newCachedRec.Status = 0
-	a.Persistent.Save(ctx, newDomainRec)
-	a.Cache.Set(ctx, domain, newCachedRec, cacheTTL)
-	resp := buildResponse(r, dns.RcodeSuccess, ips)
+// serveBlocked answers a query for a domain blocked by v, using the response
+// configured for the client's profile, for the category or the default one.
+func (a Ainaa) serveBlocked(w dns.ResponseWriter, r *dns.Msg, v verdict, cat Category, profile *Profile) (int, error) {
+	br := a.BlockResponse
+	if profile != nil && profile.BlockResponse != nil {
+		br = *profile.BlockResponse
+	} else if cat.Response != nil {
+		br = *cat.Response
+	}
+	resp := br.build(r)
+	if a.BlockEDE != 0 {
+		extraText := fmt.Sprintf("%s: %s, source %s", v.zone, a.describe(v), v.source)
+		setEDE(r, resp, a.BlockEDE, extraText)
+	}
 	w.WriteMsg(resp)
-	return dns.RcodeSuccess, nil
+	if resp.Rcode == dns.RcodeRefused {
+		// The response is written already, don't let the server write another.
+		return dns.RcodeSuccess, nil
+	}
+	return resp.Rcode, nil
 }
 
-func (a Ainaa) Name() string { return name }
+// serveRedirect answers a query for a domain redirected by cat, either to
+// its addresses or with a CNAME to its target.
+func (a Ainaa) serveRedirect(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string, cat Category) (int, error) {
+	if cat.Target == "" {
+		resp := cat.Response.build(r)
+		w.WriteMsg(resp)
+		return resp.Rcode, nil
+	}
 
-func buildResponse(r *dns.Msg, rcodeStatus int, ips map[string][]string) *dns.Msg {
+	q := r.Question[0]
 	resp := new(dns.Msg)
 	resp.SetReply(r)
 	resp.Authoritative = true
-	resp.Rcode = rcodeStatus
-	for _, ip := range ips["A"] {
-		resp.Answer = append(resp.Answer, &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   r.Question[0].Name,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    300,
-			},
-			A: net.ParseIP(ip),
-		})
+	resp.Answer = []dns.RR{&dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    answerTTL,
+		},
+		Target: cat.Target,
+	}}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		target := strings.TrimSuffix(cat.Target, ".")
+		res, err := a.resolve(ctx, target)
+		if err != nil {
+			return a.serveFailure(w, r, target, err)
+		}
+		resp.Rcode = res.Rcode
+		resp.Answer = append(resp.Answer, res.answer(cat.Target, q.Qtype)...)
+		if !res.has(q.Qtype) {
+			resp.Ns = res.negative(cat.Target)
+		}
 	}
-	for _, ip := range ips["AAAA"] {
-		resp.Answer = append(resp.Answer, &dns.AAAA{
-			Hdr: dns.RR_Header{
-				Name:   r.Question[0].Name,
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-				Ttl:    300,
-			},
-			AAAA: net.ParseIP(ip),
-		})
+	w.WriteMsg(resp)
+	return dns.RcodeSuccess, nil
+}
+
+// serveFailure answers SERVFAIL when domain could not be looked up upstream.
+// While every upstream is down the error is not returned, the breaker
+// logged it already.
+func (a Ainaa) serveFailure(w dns.ResponseWriter, r *dns.Msg, domain string, err error) (int, error) {
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeServerFailure)
+	setEDE(r, resp, lookupEDE(err), "upstream lookup failed")
+	w.WriteMsg(resp)
+	if errors.Is(err, ErrUpstreamsDown) || errors.Is(err, errRecentFailure) {
+		log.Debugf("Cannot look up domain %s: %v", domain, err)
+		return dns.RcodeSuccess, nil
 	}
-	return resp
+
+	log.Errorf("Error looking up domain %s: %v", domain, err)
+	// The response is written already, don't let the server write another.
+	return dns.RcodeSuccess, err
+}
+
+// serveNotFound answers NXDOMAIN for a domain the upstream says does not
+// exist, cacheable as long as the upstream's answer err.
+func (a Ainaa) serveNotFound(w dns.ResponseWriter, r *dns.Msg, domain string, err error) (int, error) {
+	log.Debugf("Domain %s does not exist", domain)
+	resp := buildResponse(r, dns.RcodeNameError, nil)
+	rr := soa(r.Question[0].Name).(*dns.SOA)
+	rr.Hdr.Ttl = notFoundTTL(err)
+	rr.Minttl = rr.Hdr.Ttl
+	resp.Ns = []dns.RR{rr}
+	w.WriteMsg(resp)
+	return dns.RcodeNameError, nil
 }
+
+// serveAllowed answers a query for an allowed domain with its records in res.
+// Without them, in filter-only mode or for types other than A and AAAA, the
+// query is handed to the next plugin.
+func (a Ainaa) serveAllowed(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string, res *Resolution) (int, error) {
+	if res == nil {
+		log.Debugf("Passing %s query for domain %s to the next plugin", dns.TypeToString[r.Question[0].Qtype], domain)
+		return plugin.NextOrFailure(a.Name(), a.Next, ctx, w, r)
+	}
+
+	q := r.Question[0]
+	resp := buildResponse(r, res.Rcode, nil)
+	resp.Answer = res.answer(q.Name, q.Qtype)
+	if !res.has(q.Qtype) {
+		// NXDOMAIN, or NODATA: the name exists but has no records of the
+		// requested type.
+		resp.Ns = res.negative(q.Name)
+	}
+	w.WriteMsg(resp)
+	return res.Rcode, nil
+}
+
+// answersAddresses reports whether r is an A or AAAA query, which the plugin
+// answers itself.
+func answersAddresses(r *dns.Msg) bool {
+	qtype := r.Question[0].Qtype
+	return qtype == dns.TypeA || qtype == dns.TypeAAAA
+}
+
+func (a Ainaa) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+func (a Ainaa) Name() string { return name }
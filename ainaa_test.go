@@ -3,6 +3,13 @@ package ainaa
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -53,13 +60,13 @@ func (m *MockPersistentRepository) Save(ctx context.Context, record DomainRecord
 }
 
 type MockResolver struct {
-	LookupFunc          func(domain string) (map[string][]string, error)
+	LookupFunc          func(ctx context.Context, domain string) (map[string][]string, error)
 	IsBlockedDomainFunc func(ips map[string][]string) bool
 }
 
-func (m *MockResolver) Lookup(domain string) (map[string][]string, error) {
+func (m *MockResolver) Lookup(ctx context.Context, domain string) (map[string][]string, error) {
 	if m.LookupFunc != nil {
-		return m.LookupFunc(domain)
+		return m.LookupFunc(ctx, domain)
 	}
 	return nil, nil
 }
@@ -73,13 +80,26 @@ func (m *MockResolver) IsBlockedDomain(ips map[string][]string) bool {
 
 // Tests
 
+func TestDomainAndParents(t *testing.T) {
+	got := domainAndParents("a.b.example.com")
+	want := []string{"a.b.example.com", "b.example.com", "example.com", "com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
 func TestAinaa_ServeDNS(t *testing.T) {
 	tests := []struct {
 		name           string
 		domain         string
+		qtype          uint16
+		filterOnly     bool
+		allowlist      DomainList
 		setupMocks     func(*MockCacheRepository, *MockPersistentRepository, *MockResolver)
 		expectedRcode  int
 		expectedAnswer []string
+		expectedNs     int
+		expectNext     bool
 	}{
 		{
 			name:   "Cache Hit Allowed",
@@ -107,6 +127,7 @@ func TestAinaa_ServeDNS(t *testing.T) {
 				}
 			},
 			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
 		},
 		{
 			name:   "Persistent Hit Allowed",
@@ -139,9 +160,9 @@ func TestAinaa_ServeDNS(t *testing.T) {
 					return CachedDomain{}, errors.New("miss")
 				}
 				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
-					return DomainRecord{}, errors.New("miss")
+					return DomainRecord{}, ErrDomainNotFound
 				}
-				r.LookupFunc = func(domain string) (map[string][]string, error) {
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
 					return map[string][]string{"A": {"9.9.9.9"}}, nil
 				}
 				r.IsBlockedDomainFunc = func(ips map[string][]string) bool {
@@ -171,9 +192,9 @@ func TestAinaa_ServeDNS(t *testing.T) {
 					return CachedDomain{}, errors.New("miss")
 				}
 				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
-					return DomainRecord{}, errors.New("miss")
+					return DomainRecord{}, ErrDomainNotFound
 				}
-				r.LookupFunc = func(domain string) (map[string][]string, error) {
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
 					return map[string][]string{"A": {"6.6.6.6"}}, nil
 				}
 				r.IsBlockedDomainFunc = func(ips map[string][]string) bool {
@@ -187,6 +208,7 @@ func TestAinaa_ServeDNS(t *testing.T) {
 				}
 			},
 			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
 		},
 		{
 			name:   "Cache Hit No IPs",
@@ -195,7 +217,7 @@ func TestAinaa_ServeDNS(t *testing.T) {
 				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
 					return CachedDomain{Status: 0, IPs: nil}, nil
 				}
-				r.LookupFunc = func(domain string) (map[string][]string, error) {
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
 					return map[string][]string{"A": {"10.0.0.1"}}, nil
 				}
 				// Expect NO calls to Persistent.Save or Cache.Set
@@ -221,7 +243,7 @@ func TestAinaa_ServeDNS(t *testing.T) {
 				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
 					return DomainRecord{Status: 0, IPs: nil}, nil
 				}
-				r.LookupFunc = func(domain string) (map[string][]string, error) {
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
 					return map[string][]string{"A": {"10.0.0.2"}}, nil
 				}
 				// Expect Cache.Set but NO Persistent.Save
@@ -239,6 +261,366 @@ func TestAinaa_ServeDNS(t *testing.T) {
 			expectedRcode:  dns.RcodeSuccess,
 			expectedAnswer: []string{"10.0.0.2"},
 		},
+		{
+			name:   "Cache Hit AAAA",
+			domain: "example.com",
+			qtype:  dns.TypeAAAA,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{
+						Status: 0,
+						IPs:    map[string][]string{"A": {"1.2.3.4"}, "AAAA": {"2001:db8::1"}},
+					}, nil
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"2001:db8::1"},
+		},
+		{
+			name:   "Cache Hit AAAA NODATA",
+			domain: "v4only.com",
+			qtype:  dns.TypeAAAA,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{
+						Status: 0,
+						IPs:    map[string][]string{"A": {"1.2.3.4"}},
+					}, nil
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectedNs:    1,
+		},
+		{
+			name:   "Cache Hit MX Delegated",
+			domain: "example.com",
+			qtype:  dns.TypeMX,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{Status: 0, IPs: nil}, nil
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					t.Errorf("Unexpected call to Resolver.Lookup")
+					return nil, nil
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:   "Cache Hit Blocked TXT",
+			domain: "bad.com",
+			qtype:  dns.TypeTXT,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{Status: 1}, nil
+				}
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:   "Miss Fresh Lookup SRV Delegated",
+			domain: "new.com",
+			qtype:  dns.TypeSRV,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"9.9.9.9"}}, nil
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:       "Filter Only Cache Hit Allowed",
+			domain:     "example.com",
+			filterOnly: true,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{Status: 0, IPs: nil}, nil
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					t.Errorf("Unexpected call to Resolver.Lookup")
+					return nil, nil
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:       "Filter Only Cache Hit Blocked",
+			domain:     "bad.com",
+			filterOnly: true,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{Status: 1}, nil
+				}
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:       "Filter Only Miss Not Found",
+			domain:     "internal.corp",
+			filterOnly: true,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return nil, errNotFound(domain, "", 0)
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:       "Filter Only Cached Not Found",
+			domain:     "internal.corp",
+			filterOnly: true,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					if domain == "internal.corp" {
+						return CachedDomain{NoInherit: true, Source: sourceResolver, Negative: negativeNXDomain, Expires: time.Now().Add(time.Hour).Unix()}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:       "Filter Only Miss Allowed",
+			domain:     "new.com",
+			filterOnly: true,
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"9.9.9.9"}}, nil
+				}
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectNext:    true,
+		},
+		{
+			name:   "Parent Cache Hit Blocked",
+			domain: "a.b.evil.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					if domain == "evil.com" {
+						return CachedDomain{Status: 1}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					t.Errorf("Unexpected call to Resolver.Lookup")
+					return nil, nil
+				}
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:   "Parent Persistent Hit Blocked",
+			domain: "cdn.evil.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					if domain == "evil.com" {
+						return DomainRecord{Domain: domain, Status: 2}, nil
+					}
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				c.SetFunc = func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+					if !value.Absent && (domain != "evil.com" || value.Status != 2 || value.NoInherit) {
+						t.Errorf("Unexpected cache set %s: %v", domain, value)
+					}
+					return nil
+				}
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:   "Most Specific Record Wins",
+			domain: "good.evil.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					switch domain {
+					case "good.evil.com":
+						return CachedDomain{Status: 0, IPs: map[string][]string{"A": {"1.1.1.1"}}}, nil
+					case "evil.com":
+						return CachedDomain{Status: 1}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"1.1.1.1"},
+		},
+		{
+			name:   "Parent Allowed Does Not Leak IPs",
+			domain: "www.example.net",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					if domain == "example.net" {
+						return CachedDomain{Status: 0, IPs: map[string][]string{"A": {"1.1.1.1"}}}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					if domain != "www.example.net" {
+						t.Errorf("Unexpected lookup for %s", domain)
+					}
+					return map[string][]string{"A": {"2.2.2.2"}}, nil
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"2.2.2.2"},
+		},
+		{
+			name:   "Parent Without Inherit Ignored",
+			domain: "sub.exact.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					if domain == "exact.com" {
+						return CachedDomain{Status: 1, NoInherit: true}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"3.3.3.3"}}, nil
+				}
+				p.SaveFunc = func(ctx context.Context, record DomainRecord) error {
+					if record.Domain != "sub.exact.com" || !record.NoInherit {
+						t.Errorf("Unexpected persistent save value: %v", record)
+					}
+					return nil
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"3.3.3.3"},
+		},
+		{
+			name:   "Parent Block Overrides Resolver Record",
+			domain: "cdn.evil.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					switch domain {
+					case "cdn.evil.com":
+						return CachedDomain{IPs: map[string][]string{"A": {"4.4.4.4"}}, NoInherit: true, Source: sourceResolver}, nil
+					case "evil.com":
+						return CachedDomain{Status: 1}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:   "Status 0 Parent Not Inherited",
+			domain: "www.legacy.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					if domain == "legacy.com" {
+						return CachedDomain{Status: 0, IPs: map[string][]string{"A": {"5.5.5.5"}}}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					return DomainRecord{}, ErrDomainNotFound
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"146.112.61.106"}}, nil
+				}
+				// Only the classification of the subdomain blocks it.
+				r.IsBlockedDomainFunc = func(ips map[string][]string) bool { return true }
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedNs:    1,
+		},
+		{
+			name:      "Allowlisted Subdomain Skips Lookups",
+			domain:    "api.partner.com",
+			allowlist: DomainList{"partner.com": {}},
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					t.Errorf("Unexpected call to Cache.Get")
+					return CachedDomain{Status: 1}, nil
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"10.1.1.1"}}, nil
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"10.1.1.1"},
+		},
+		{
+			name:   "Allow Flag Overrides Blocked Subdomain",
+			domain: "x.partner.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					switch domain {
+					case "x.partner.com":
+						return CachedDomain{Status: 1, Source: sourceResolver}, nil
+					case "partner.com":
+						return CachedDomain{Allow: true}, nil
+					}
+					return CachedDomain{}, errors.New("miss")
+				}
+				r.LookupFunc = func(ctx context.Context, domain string) (map[string][]string, error) {
+					return map[string][]string{"A": {"10.2.2.2"}}, nil
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"10.2.2.2"},
+		},
+		{
+			name:   "Allow Flag On Exact Record",
+			domain: "fp.example.com",
+			setupMocks: func(c *MockCacheRepository, p *MockPersistentRepository, r *MockResolver) {
+				c.GetFunc = func(ctx context.Context, domain string) (CachedDomain, error) {
+					return CachedDomain{}, errors.New("miss")
+				}
+				p.GetFunc = func(ctx context.Context, domain string) (DomainRecord, error) {
+					if domain == "fp.example.com" {
+						return DomainRecord{Status: 3, Allow: true, IPs: map[string][]string{"A": {"10.3.3.3"}}}, nil
+					}
+					return DomainRecord{}, ErrDomainNotFound
+				}
+			},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []string{"10.3.3.3"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -249,15 +631,29 @@ func TestAinaa_ServeDNS(t *testing.T) {
 
 			tt.setupMocks(mockCache, mockPersistent, mockResolver)
 
+			nextCalled := false
 			a := Ainaa{
-				Next:       plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) { return 0, nil }),
-				Cache:      mockCache,
-				Persistent: mockPersistent,
-				Resolver:   mockResolver,
+				Next: plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+					nextCalled = true
+					m := new(dns.Msg)
+					m.SetReply(r)
+					w.WriteMsg(m)
+					return dns.RcodeSuccess, nil
+				}),
+				Cache:       mockCache,
+				Persistent:  mockPersistent,
+				Resolver:    mockResolver,
+				FilterOnly:  tt.filterOnly,
+				Allowlist:   tt.allowlist,
+				BlockStatus: defaultBlockStatus,
 			}
 
+			qtype := tt.qtype
+			if qtype == 0 {
+				qtype = dns.TypeA
+			}
 			r := new(dns.Msg)
-			r.SetQuestion(tt.domain+".", dns.TypeA)
+			r.SetQuestion(tt.domain+".", qtype)
 			rec := dnstest.NewRecorder(&test.ResponseWriter{})
 
 			a.ServeDNS(context.TODO(), rec, r)
@@ -266,15 +662,1108 @@ func TestAinaa_ServeDNS(t *testing.T) {
 				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
 			}
 
+			if nextCalled != tt.expectNext {
+				t.Errorf("Expected next plugin called %t, got %t", tt.expectNext, nextCalled)
+			}
+
+			if len(rec.Msg.Ns) != tt.expectedNs {
+				t.Errorf("Expected %d authority records, got %d", tt.expectedNs, len(rec.Msg.Ns))
+			}
+
+			for _, rr := range rec.Msg.Answer {
+				if rr.Header().Rrtype != qtype {
+					t.Errorf("Expected only %s answers, got %s", dns.TypeToString[qtype], rr)
+				}
+			}
+
 			if len(tt.expectedAnswer) > 0 {
 				if len(rec.Msg.Answer) == 0 {
 					t.Errorf("Expected answer, got none")
 				} else {
-					// Check IP
-					// Simplified check
-					// ...
+					var got []string
+					for _, rr := range rec.Msg.Answer {
+						switch rr := rr.(type) {
+						case *dns.A:
+							got = append(got, rr.A.String())
+						case *dns.AAAA:
+							got = append(got, rr.AAAA.String())
+						}
+					}
+					if !reflect.DeepEqual(got, tt.expectedAnswer) {
+						t.Errorf("Expected answer %v, got %v", tt.expectedAnswer, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSBlockResponse(t *testing.T) {
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				if domain == "gambling.com" {
+					return CachedDomain{Status: 3}, nil
 				}
+				return CachedDomain{Status: 1}, nil
+			},
+		},
+		Persistent:    &MockPersistentRepository{},
+		Resolver:      &MockResolver{},
+		BlockResponse: BlockResponse{Style: BlockNoData},
+		Categories: map[int]Category{
+			3: {Name: "gambling", Action: ActionBlock, Response: &BlockResponse{Style: BlockRefused}},
+		},
+	}
+
+	tests := []struct {
+		domain         string
+		expectedRcode  int
+		expectedReturn int
+	}{
+		{domain: "malware.com", expectedRcode: dns.RcodeSuccess, expectedReturn: dns.RcodeSuccess},
+		{domain: "gambling.com", expectedRcode: dns.RcodeRefused, expectedReturn: dns.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.domain+".", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			rcode, err := a.ServeDNS(context.TODO(), rec, r)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if rcode != tt.expectedReturn {
+				t.Errorf("Expected return code %d, got %d", tt.expectedReturn, rcode)
+			}
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
 			}
 		})
 	}
 }
+
+func TestAinaa_ServeDNSExtendedErrors(t *testing.T) {
+	miss := func(ctx context.Context, domain string) (CachedDomain, error) {
+		return CachedDomain{}, errors.New("miss")
+	}
+
+	tests := []struct {
+		name          string
+		edns          bool
+		cacheGet      func(ctx context.Context, domain string) (CachedDomain, error)
+		lookupErr     error
+		expectedRcode int
+		expectedEDE   uint16
+		expectedText  string
+		expectNoOPT   bool
+	}{
+		{
+			name: "Blocked",
+			edns: true,
+			cacheGet: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{Status: 2, NoInherit: true, Source: sourceResolver}, nil
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectedEDE:   dns.ExtendedErrorCodeBlocked,
+			expectedText:  "blocked.com: status 2, source resolver",
+		},
+		{
+			name: "Blocked Without EDNS",
+			cacheGet: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{Status: 2}, nil
+			},
+			expectedRcode: dns.RcodeNameError,
+			expectNoOPT:   true,
+		},
+		{
+			name:          "Lookup Failure",
+			edns:          true,
+			cacheGet:      miss,
+			lookupErr:     errors.New("failed to resolve domain"),
+			expectedRcode: dns.RcodeServerFailure,
+			expectedEDE:   dns.ExtendedErrorCodeNoReachableAuthority,
+		},
+		{
+			name:          "Lookup Timeout",
+			edns:          true,
+			cacheGet:      miss,
+			lookupErr:     &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			expectedRcode: dns.RcodeServerFailure,
+			expectedEDE:   dns.ExtendedErrorCodeNetworkError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Ainaa{
+				Cache: &MockCacheRepository{GetFunc: tt.cacheGet},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+				},
+				Resolver: &MockResolver{
+					LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+						return nil, tt.lookupErr
+					},
+				},
+				BlockEDE: dns.ExtendedErrorCodeBlocked,
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion("blocked.com.", dns.TypeA)
+			if tt.edns {
+				r.SetEdns0(4096, false)
+			}
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			rcode, _ := a.ServeDNS(context.TODO(), rec, r)
+			if !plugin.ClientWrite(rcode) {
+				t.Errorf("Expected the response to be written by the plugin, got return code %d", rcode)
+			}
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+
+			opt := rec.Msg.IsEdns0()
+			if tt.expectNoOPT {
+				if opt != nil {
+					t.Errorf("Expected no OPT record, got %v", opt)
+				}
+				return
+			}
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("Expected one EDNS0 option, got %v", opt)
+			}
+			ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+			if !ok {
+				t.Fatalf("Expected an EDE option, got %T", opt.Option[0])
+			}
+			if ede.InfoCode != tt.expectedEDE {
+				t.Errorf("Expected EDE %d, got %d", tt.expectedEDE, ede.InfoCode)
+			}
+			if tt.expectedText != "" && ede.ExtraText != tt.expectedText {
+				t.Errorf("Expected EDE text %q, got %q", tt.expectedText, ede.ExtraText)
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSCategories(t *testing.T) {
+	statuses := map[string]int{
+		"malware.com":  1,
+		"adult.com":    2,
+		"casino.com":   3,
+		"ads.com":      4,
+		"search.com":   5,
+		"unknown.com":  9,
+		"safe.com":     0,
+		"phishing.com": 6,
+	}
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				status, ok := statuses[domain]
+				if !ok {
+					return CachedDomain{}, errors.New("miss")
+				}
+				return CachedDomain{Status: status, IPs: map[string][]string{"A": {"198.51.100.1"}}}, nil
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				return DomainRecord{}, ErrDomainNotFound
+			},
+		},
+		Resolver: &MockResolver{
+			LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+				if domain != "forcesafesearch.example" {
+					t.Errorf("Unexpected lookup for %s", domain)
+				}
+				return map[string][]string{"A": {"203.0.113.7"}}, nil
+			},
+		},
+		BlockEDE: dns.ExtendedErrorCodeBlocked,
+		Categories: map[int]Category{
+			1: {Name: "malware", Action: ActionBlock},
+			2: {Name: "adult", Action: ActionAllow},
+			3: {Name: "gambling", Action: ActionLog},
+			4: {Name: "ads", Action: ActionRedirect, Response: &BlockResponse{Style: BlockSinkhole, IPs: map[string][]string{"A": {"192.0.2.1"}}}},
+			5: {Name: "search", Action: ActionRedirect, Target: "forcesafesearch.example."},
+			6: {Name: "phishing", Action: ActionBlock, Response: &BlockResponse{Style: BlockNullIP}},
+		},
+	}
+
+	tests := []struct {
+		domain         string
+		expectedRcode  int
+		expectedAnswer []string
+		expectedText   string
+	}{
+		{domain: "malware.com", expectedRcode: dns.RcodeNameError, expectedText: "malware.com: malware (status 1), source dynamodb"},
+		{domain: "adult.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"198.51.100.1"}},
+		{domain: "casino.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"198.51.100.1"}},
+		{domain: "ads.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"192.0.2.1"}},
+		{domain: "search.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"forcesafesearch.example.", "203.0.113.7"}},
+		{domain: "unknown.com", expectedRcode: dns.RcodeNameError, expectedText: "unknown.com: status 9, source dynamodb"},
+		{domain: "safe.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"198.51.100.1"}},
+		{domain: "phishing.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"0.0.0.0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.domain+".", dns.TypeA)
+			r.SetEdns0(4096, false)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			a.ServeDNS(context.TODO(), rec, r)
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+
+			var got []string
+			for _, rr := range rec.Msg.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.CNAME:
+					got = append(got, rr.Target)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expectedAnswer) {
+				t.Errorf("Expected answer %v, got %v", tt.expectedAnswer, got)
+			}
+
+			if tt.expectedText != "" {
+				opt := rec.Msg.IsEdns0()
+				if opt == nil || len(opt.Option) == 0 {
+					t.Fatalf("Expected an EDE option")
+				}
+				if text := opt.Option[0].(*dns.EDNS0_EDE).ExtraText; text != tt.expectedText {
+					t.Errorf("Expected EDE text %q, got %q", tt.expectedText, text)
+				}
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSProfiles(t *testing.T) {
+	statuses := map[string]int{
+		"malware.com": 1,
+		"adult.com":   2,
+		"casino.com":  3,
+	}
+	kids, err := newProfile(ProfileRecord{
+		Name:            "kids",
+		Networks:        []string{"10.240.0.0/16"},
+		BlockCategories: []string{"adult"},
+		AllowCategories: []string{"gambling"},
+		Allow:           []string{"malware.com"},
+		Deny:            []string{"games.example", "safe.games.example"},
+		BlockResponse:   "sinkhole 192.0.2.1",
+	}, map[int]Category{2: {Name: "adult"}, 3: {Name: "gambling"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	office, err := newProfile(ProfileRecord{Name: "office", Networks: []string{"10.0.0.0/8"}, Deny: []string{"adult.com"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := NewProfiles([]*Profile{office, kids}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				status, ok := statuses[domain]
+				if !ok {
+					return CachedDomain{}, errors.New("miss")
+				}
+				return CachedDomain{Status: status, IPs: map[string][]string{"A": {"198.51.100.1"}}}, nil
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				return DomainRecord{}, ErrDomainNotFound
+			},
+		},
+		Resolver: &MockResolver{
+			LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+				return map[string][]string{"A": {"203.0.113.7"}}, nil
+			},
+		},
+		Categories: map[int]Category{
+			2: {Name: "adult", Action: ActionAllow},
+			3: {Name: "gambling", Action: ActionBlock},
+		},
+		Profiles: profiles,
+	}
+
+	// test.ResponseWriter reports 10.240.0.1 as the client, which is in both
+	// networks; the more specific kids profile applies.
+	tests := []struct {
+		domain         string
+		expectedRcode  int
+		expectedAnswer []string
+	}{
+		{domain: "games.example", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"192.0.2.1"}},
+		{domain: "www.games.example", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"192.0.2.1"}},
+		{domain: "safe.games.example", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"192.0.2.1"}},
+		{domain: "malware.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"203.0.113.7"}},
+		{domain: "adult.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"192.0.2.1"}},
+		{domain: "casino.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"198.51.100.1"}},
+		{domain: "other.com", expectedRcode: dns.RcodeSuccess, expectedAnswer: []string{"203.0.113.7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.domain+".", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			a.ServeDNS(context.TODO(), rec, r)
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+
+			var got []string
+			for _, rr := range rec.Msg.Answer {
+				if rr, ok := rr.(*dns.A); ok {
+					got = append(got, rr.A.String())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expectedAnswer) {
+				t.Errorf("Expected answer %v, got %v", tt.expectedAnswer, got)
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSSchedules(t *testing.T) {
+	school := &Schedule{Name: "school", Location: time.UTC, Windows: []Window{{Days: 0x3e, Start: 8 * 60, End: 16 * 60}}}
+	nights := &Schedule{Name: "nights", Location: time.UTC, Windows: []Window{{Days: 0x7f, Start: 22 * 60, End: 7 * 60}}}
+	schedules := map[string]*Schedule{"school": school, "nights": nights}
+	categories := map[int]Category{6: {Name: "social", Action: ActionAllow}}
+
+	kids, err := newProfile(ProfileRecord{
+		Name:     "kids",
+		Networks: []string{"10.240.0.0/16"},
+		Deny:     []string{"games.example"},
+		Schedule: "school",
+	}, categories, schedules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := newProfile(ProfileRecord{
+		Name:      "home",
+		Networks:  []string{"10.0.0.0/8"},
+		Scheduled: []string{"nights block social"},
+	}, categories, schedules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := NewProfiles([]*Profile{kids, home}, categories, schedules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var now time.Time
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				if domain == "social.example" {
+					return CachedDomain{Status: 6, IPs: map[string][]string{"A": {"198.51.100.6"}}}, nil
+				}
+				return CachedDomain{Status: 0, IPs: map[string][]string{"A": {"198.51.100.1"}}}, nil
+			},
+		},
+		Persistent: &MockPersistentRepository{},
+		Resolver:   &MockResolver{},
+		Categories: categories,
+		Profiles:   profiles,
+		now:        func() time.Time { return now },
+	}
+
+	tests := []struct {
+		time          string
+		domain        string
+		expectedRcode int
+	}{
+		{time: "2026-10-19T10:00:00Z", domain: "games.example", expectedRcode: dns.RcodeNameError},
+		{time: "2026-10-19T10:00:00Z", domain: "social.example", expectedRcode: dns.RcodeSuccess},
+		{time: "2026-10-19T18:00:00Z", domain: "games.example", expectedRcode: dns.RcodeSuccess},
+		{time: "2026-10-19T18:00:00Z", domain: "social.example", expectedRcode: dns.RcodeSuccess},
+		{time: "2026-10-19T23:00:00Z", domain: "social.example", expectedRcode: dns.RcodeNameError},
+		{time: "2026-10-20T06:00:00Z", domain: "social.example", expectedRcode: dns.RcodeNameError},
+		{time: "2026-10-18T10:00:00Z", domain: "games.example", expectedRcode: dns.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.time+" "+tt.domain, func(t *testing.T) {
+			now, err = time.Parse(time.RFC3339, tt.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := new(dns.Msg)
+			r.SetQuestion(tt.domain+".", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+			a.ServeDNS(context.TODO(), rec, r)
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSClassifierVerdicts(t *testing.T) {
+	var saved DomainRecord
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{}, errors.New("miss")
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				return DomainRecord{}, ErrDomainNotFound
+			},
+			SaveFunc: func(ctx context.Context, record DomainRecord) error {
+				saved = record
+				return nil
+			},
+		},
+		Resolver: &MockResolver{
+			LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+				t.Errorf("Unexpected call to Resolver.Lookup")
+				return nil, nil
+			},
+		},
+		Classifier: &Consensus{
+			Classifiers: []WeightedClassifier{
+				{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 1},
+				{Classifier: verdictOf("opendns", true, "146.112.61.106", nil), Weight: 1},
+				{Classifier: verdictOf("adguard", false, "192.0.2.1", nil), Weight: 1},
+			},
+			Strategy: StrategyMajority,
+		},
+		BlockStatus: defaultBlockStatus,
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("tracker.example.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	a.ServeDNS(context.TODO(), rec, r)
+
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected Rcode %d, got %d", dns.RcodeNameError, rec.Msg.Rcode)
+	}
+	expected := []ProviderVerdict{
+		{Provider: "quad9", Blocked: true},
+		{Provider: "opendns", Blocked: true},
+		{Provider: "adguard", Blocked: false},
+	}
+	if saved.Status != defaultBlockStatus || !reflect.DeepEqual(saved.Verdicts, expected) {
+		t.Errorf("Expected a blocked record with verdicts %+v, got %+v", expected, saved)
+	}
+
+	// A verdict some classifiers failed to take part in is not stored.
+	saved = DomainRecord{}
+	a.Classifier = &Consensus{
+		Classifiers: []WeightedClassifier{
+			{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 1},
+			{Classifier: verdictOf("opendns", true, "146.112.61.106", nil), Weight: 1},
+			{Classifier: verdictOf("adguard", false, "", errors.New("timeout")), Weight: 1},
+		},
+		Strategy: StrategyMajority,
+	}
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	a.ServeDNS(context.TODO(), rec, r)
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected Rcode %d, got %d", dns.RcodeNameError, rec.Msg.Rcode)
+	}
+	if saved.Domain != "" {
+		t.Errorf("Expected the partial verdict not stored, got %+v", saved)
+	}
+
+	// A classifier being down does not degrade a domain another one blocks.
+	a.Degraded = DegradedAllow
+	a.Classifier = &Consensus{
+		Classifiers: []WeightedClassifier{
+			{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 1},
+			{Classifier: verdictOf("opendns", false, "", ErrUpstreamsDown), Weight: 1},
+		},
+		Strategy: StrategyAny,
+	}
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	a.ServeDNS(context.TODO(), rec, r)
+	if rec.Msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected Rcode %d, got %d", dns.RcodeNameError, rec.Msg.Rcode)
+	}
+}
+
+func TestAinaa_ServeDNSDegraded(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          DegradedMode
+		known         *CachedDomain
+		expectedRcode int
+		expectedIP    string
+		expectedErr   bool
+	}{
+		{name: "Allow", mode: DegradedAllow, expectedRcode: dns.RcodeSuccess},
+		{name: "Block", mode: DegradedBlock, expectedRcode: dns.RcodeNameError},
+		{
+			name:          "Stale",
+			mode:          DegradedStale,
+			known:         &CachedDomain{IPs: map[string][]string{"A": {"192.0.2.1"}}, Source: sourceResolver},
+			expectedRcode: dns.RcodeSuccess,
+			expectedIP:    "192.0.2.1",
+		},
+		{
+			name:          "Stale Blocked",
+			mode:          DegradedStale,
+			known:         &CachedDomain{Status: defaultBlockStatus, Source: sourceResolver},
+			expectedRcode: dns.RcodeNameError,
+		},
+		{name: "Stale Unknown", mode: DegradedStale, expectedRcode: dns.RcodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+						if !value.Absent {
+							t.Errorf("Unexpected cache of %s while upstreams are down", domain)
+						}
+						return nil
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+					SaveFunc: func(ctx context.Context, record DomainRecord) error {
+						t.Errorf("Unexpected save of %s while upstreams are down", record.Domain)
+						return nil
+					},
+				},
+				Classifier: verdictOf("opendns", false, "", ErrUpstreamsDown),
+				Resolver: &MockResolver{
+					LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+						return map[string][]string{"A": {"192.0.2.9"}}, nil
+					},
+				},
+				BlockStatus: defaultBlockStatus,
+				Degraded:    tt.mode,
+				lastKnown:   newLastKnown(defaultLastKnownSize),
+			}
+			if tt.known != nil {
+				a.lastKnown.set("example.com", *tt.known)
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+				t.Errorf("Expected no errors while upstreams are down, but got: %v", err)
+			}
+
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			if tt.expectedIP != "" {
+				if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != tt.expectedIP {
+					t.Errorf("Expected the last known address %s, got %v", tt.expectedIP, rec.Msg.Answer)
+				}
+			}
+		})
+	}
+}
+
+func TestLastKnown(t *testing.T) {
+	l := newLastKnown(2)
+	l.set("a.com", CachedDomain{Status: 1})
+	l.set("b.com", CachedDomain{Status: 2})
+	l.set("a.com", CachedDomain{Status: 3})
+	l.set("c.com", CachedDomain{Status: 4})
+
+	if _, ok := l.get("a.com"); ok {
+		t.Errorf("Expected the oldest entry to be dropped")
+	}
+	if rec, ok := l.get("b.com"); !ok || rec.Status != 2 {
+		t.Errorf("Expected b.com with status 2, got %+v, %t", rec, ok)
+	}
+	if rec, ok := l.get("c.com"); !ok || rec.Status != 4 {
+		t.Errorf("Expected c.com with status 4, got %+v, %t", rec, ok)
+	}
+
+	var disabled *lastKnown
+	disabled.set("a.com", CachedDomain{})
+	if _, ok := disabled.get("a.com"); ok {
+		t.Errorf("Expected nothing remembered without a store")
+	}
+}
+
+func TestAinaa_ServeDNSTimeout(t *testing.T) {
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{}, errors.New("miss")
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				return DomainRecord{}, ErrDomainNotFound
+			},
+		},
+		Resolver: &MockResolver{
+			LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+				// A slow upstream, only giving up when the query does.
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("slow.example.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	start := time.Now()
+	_, err := a.ServeDNS(context.TODO(), rec, r)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the query to give up after its timeout, took %s", elapsed)
+	}
+	if rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected Rcode %d, got %d", dns.RcodeServerFailure, rec.Msg.Rcode)
+	}
+}
+
+func TestOpenDNSResolver_LookupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := &OpenDNSResolver{Upstreams: NewUpstreams([]string{"192.0.2.1:53", "192.0.2.2:53"}, UpstreamOptions{Stagger: defaultStagger})}
+	start := time.Now()
+	if _, err := r.Lookup(ctx, "example.com"); err == nil {
+		t.Fatalf("Expected an error, but got none")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to stop at once, took %s", elapsed)
+	}
+}
+
+func TestAinaa_ServeDNSUpstreamAnswers(t *testing.T) {
+	s := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		negative := []dns.RR{test.SOA("example.com. 3600 IN SOA ns. host. 1 2 3 4 120")}
+		if q.Name == "gone.example.com." {
+			return dns.RcodeNameError, nil, negative
+		}
+		alias := test.CNAME(q.Name + " 30 IN CNAME cdn.example.net.")
+		if q.Qtype == dns.TypeA {
+			return dns.RcodeSuccess, []dns.RR{alias, test.A("cdn.example.net. 300 IN A 192.0.2.1")}, nil
+		}
+		return dns.RcodeSuccess, []dns.RR{alias}, negative
+	})
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		cached        *CachedDomain
+		expectedRcode int
+		// expectedAnswer is the answer section, a negative answer with an SOA if empty.
+		expectedAnswer []dns.RR
+	}{
+		{
+			name:          "Alias",
+			qname:         "www.example.com.",
+			qtype:         dns.TypeA,
+			expectedRcode: dns.RcodeSuccess,
+			// The cached addresses live as long as the alias.
+			expectedAnswer: []dns.RR{
+				test.CNAME("www.example.com. 30 IN CNAME cdn.example.net."),
+				test.A("cdn.example.net. 30 IN A 192.0.2.1"),
+			},
+		},
+		{
+			name:           "NODATA",
+			qname:          "www.example.com.",
+			qtype:          dns.TypeAAAA,
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []dns.RR{test.CNAME("www.example.com. 30 IN CNAME cdn.example.net.")},
+		},
+		{name: "NXDOMAIN", qname: "gone.example.com.", qtype: dns.TypeA, expectedRcode: dns.RcodeNameError},
+		{
+			name:           "Cached Addresses",
+			qname:          "www.example.com.",
+			qtype:          dns.TypeA,
+			cached:         &CachedDomain{IPs: map[string][]string{"A": {"192.0.2.9"}}, IPsExpire: now.Add(100 * time.Second).Unix(), Source: sourceResolver},
+			expectedRcode:  dns.RcodeSuccess,
+			expectedAnswer: []dns.RR{test.A("www.example.com. 100 IN A 192.0.2.9")},
+		},
+		{
+			name:          "Expired Addresses",
+			qname:         "www.example.com.",
+			qtype:         dns.TypeA,
+			cached:        &CachedDomain{IPs: map[string][]string{"A": {"192.0.2.9"}}, IPsExpire: now.Add(-time.Second).Unix(), Source: sourceResolver},
+			expectedRcode: dns.RcodeSuccess,
+			expectedAnswer: []dns.RR{
+				test.CNAME("www.example.com. 30 IN CNAME cdn.example.net."),
+				test.A("cdn.example.net. 300 IN A 192.0.2.1"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved *CachedDomain
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						if tt.cached != nil && dns.Fqdn(domain) == tt.qname {
+							return *tt.cached, nil
+						}
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+						saved = &value
+						return nil
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+					SaveFunc: func(ctx context.Context, record DomainRecord) error { return nil },
+				},
+				Resolver: &OpenDNSResolver{Upstreams: NewUpstreams([]string{s.Addr}, UpstreamOptions{})},
+				now:      func() time.Time { return now },
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, tt.qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			if fmt.Sprint(rec.Msg.Answer) != fmt.Sprint(tt.expectedAnswer) {
+				t.Errorf("Expected answer %v, got %v", tt.expectedAnswer, rec.Msg.Answer)
+			}
+			if hasAddress := len(tt.expectedAnswer) > 0 && tt.expectedAnswer[len(tt.expectedAnswer)-1].Header().Rrtype == tt.qtype; !hasAddress && len(rec.Msg.Ns) != 1 {
+				t.Errorf("Expected a negative answer with an SOA, got %v", rec.Msg.Ns)
+			}
+			if tt.cached == nil && tt.expectedRcode == dns.RcodeSuccess && (saved == nil || saved.IPsExpire != now.Add(30*time.Second).Unix()) {
+				t.Errorf("Expected the addresses cached for the upstream's TTL, got %+v", saved)
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSUncloak(t *testing.T) {
+	s := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		var target string
+		switch q.Name {
+		case "metrics.shop.example.":
+			target = "shop.tracker.example."
+		case "www.shop.example.":
+			target = "cdn.example.net."
+		default:
+			return dns.RcodeNameError, nil, nil
+		}
+		if q.Qtype != dns.TypeA {
+			return dns.RcodeSuccess, []dns.RR{test.CNAME(q.Name + " 60 IN CNAME " + target)}, nil
+		}
+		return dns.RcodeSuccess, []dns.RR{
+			test.CNAME(q.Name + " 60 IN CNAME " + target),
+			test.A(target + " 60 IN A 192.0.2.1"),
+		}, nil
+	})
+
+	tests := []struct {
+		name          string
+		qname         string
+		allowlist     DomainList
+		expectedRcode int
+		expectedZone  string
+	}{
+		{name: "Cloaked Tracker", qname: "metrics.shop.example.", expectedRcode: dns.RcodeNameError, expectedZone: "tracker.example"},
+		{name: "Clean Alias", qname: "www.shop.example.", expectedRcode: dns.RcodeSuccess},
+		{
+			name:          "Allowlisted",
+			qname:         "metrics.shop.example.",
+			allowlist:     DomainList{"shop.example": {}},
+			expectedRcode: dns.RcodeSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error { return nil },
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						if domain == "tracker.example" {
+							return DomainRecord{Domain: domain, Status: 1}, nil
+						}
+						return DomainRecord{}, ErrDomainNotFound
+					},
+					SaveFunc: func(ctx context.Context, record DomainRecord) error { return nil },
+				},
+				Resolver:  &OpenDNSResolver{Upstreams: NewUpstreams([]string{s.Addr}, UpstreamOptions{})},
+				Allowlist: tt.allowlist,
+				BlockEDE:  dns.ExtendedErrorCodeBlocked,
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, dns.TypeA)
+			r.SetEdns0(4096, false)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			if tt.expectedZone == "" {
+				if len(rec.Msg.Answer) != 2 {
+					t.Errorf("Expected the CNAME chain and the address, got %v", rec.Msg.Answer)
+				}
+				return
+			}
+			if len(rec.Msg.Answer) != 0 {
+				t.Errorf("Expected the whole answer blocked, got %v", rec.Msg.Answer)
+			}
+			ede, ok := rec.Msg.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+			if !ok || !strings.HasPrefix(ede.ExtraText, tt.expectedZone+":") {
+				t.Errorf("Expected the block to name %s, got %v", tt.expectedZone, rec.Msg.IsEdns0().Option)
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSIPBlocklist(t *testing.T) {
+	s := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		if q.Qtype != dns.TypeA {
+			return dns.RcodeSuccess, nil, nil
+		}
+		return dns.RcodeSuccess, []dns.RR{
+			test.A(q.Name + " 60 IN A 192.0.2.1"),
+			test.A(q.Name + " 60 IN A 203.0.113.9"),
+		}, nil
+	})
+
+	tests := []struct {
+		name          string
+		action        IPAction
+		allowlist     DomainList
+		expectedRcode int
+		expectedIPs   []string
+	}{
+		{name: "Block", action: IPActionBlock, expectedRcode: dns.RcodeNameError},
+		{name: "Strip", action: IPActionStrip, expectedRcode: dns.RcodeSuccess, expectedIPs: []string{"192.0.2.1"}},
+		{
+			name:          "Allowlisted",
+			action:        IPActionBlock,
+			allowlist:     DomainList{"example.com": {}},
+			expectedRcode: dns.RcodeSuccess,
+			expectedIPs:   []string{"192.0.2.1", "203.0.113.9"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error { return nil },
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+					SaveFunc: func(ctx context.Context, record DomainRecord) error { return nil },
+				},
+				Resolver:    &OpenDNSResolver{Upstreams: NewUpstreams([]string{s.Addr}, UpstreamOptions{})},
+				Allowlist:   tt.allowlist,
+				BlockStatus: defaultBlockStatus,
+				IPBlocklist: PrefixList{netip.MustParsePrefix("203.0.113.0/24")},
+				IPAction:    tt.action,
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion("www.example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			var ips []string
+			for _, rr := range rec.Msg.Answer {
+				ips = append(ips, rr.(*dns.A).A.String())
+			}
+			if !reflect.DeepEqual(ips, tt.expectedIPs) {
+				t.Errorf("Expected addresses %v, got %v", tt.expectedIPs, ips)
+			}
+		})
+	}
+}
+
+func TestAinaa_DecideCoalesced(t *testing.T) {
+	release := make(chan struct{})
+	var gets, lookups, saves atomic.Int32
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{}, errors.New("miss")
+			},
+			SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error { return nil },
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				gets.Add(1)
+				return DomainRecord{}, ErrDomainNotFound
+			},
+			SaveFunc: func(ctx context.Context, record DomainRecord) error {
+				saves.Add(1)
+				return nil
+			},
+		},
+		Resolver: &MockResolver{
+			LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+				lookups.Add(1)
+				<-release
+				return map[string][]string{"A": {"192.0.2.1"}}, nil
+			},
+		},
+		lookups: newFlightGroup[verdict](),
+	}
+
+	const queries = 20
+	var wg sync.WaitGroup
+	for range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := a.decide(context.TODO(), "viral.example", nil)
+			if err != nil || v.ips["A"][0] != "192.0.2.1" {
+				t.Errorf("Expected the looked up address, got %+v, %v", v, err)
+			}
+		}()
+	}
+	waitForWaiters(t, a.lookups, "viral.example", queries)
+	close(release)
+	wg.Wait()
+
+	// viral.example and example, once each.
+	if n := gets.Load(); n != 2 {
+		t.Errorf("Expected 2 DynamoDB lookups, got %d", n)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("Expected 1 resolver lookup, got %d", n)
+	}
+	if n := saves.Load(); n != 1 {
+		t.Errorf("Expected 1 save, got %d", n)
+	}
+}
+
+func TestAinaa_DecideAbsentZones(t *testing.T) {
+	cache := map[string]CachedDomain{"x.ads.example": {Status: 1}}
+	var gets []string
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				if value, ok := cache[domain]; ok {
+					return value, nil
+				}
+				return CachedDomain{}, errors.New("miss")
+			},
+			SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+				cache[domain] = value
+				return nil
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				gets = append(gets, domain)
+				return DomainRecord{}, ErrDomainNotFound
+			},
+		},
+		CacheTTL: time.Hour,
+	}
+
+	// The walk looks for an allow record up to the TLD, asking DynamoDB for
+	// each parent missing from the cache only once.
+	for i := range 3 {
+		v, err := a.decide(context.TODO(), "x.ads.example", nil)
+		if err != nil || v.status != 1 || v.zone != "x.ads.example" {
+			t.Fatalf("Query %d: expected the cached block, got %+v, %v", i, v, err)
+		}
+	}
+	if !reflect.DeepEqual(gets, []string{"ads.example", "example"}) {
+		t.Errorf("Expected DynamoDB asked once for each parent, got %v", gets)
+	}
+	if !cache["ads.example"].Absent || !cache["example"].Absent {
+		t.Errorf("Expected the parents cached as absent, got %+v", cache)
+	}
+}
+
+func TestAinaa_ServeDNSPersistentError(t *testing.T) {
+	a := Ainaa{
+		Cache: &MockCacheRepository{
+			GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+				return CachedDomain{}, errors.New("miss")
+			},
+		},
+		Persistent: &MockPersistentRepository{
+			GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+				return DomainRecord{}, errors.New("ProvisionedThroughputExceededException")
+			},
+			SaveFunc: func(ctx context.Context, record DomainRecord) error {
+				t.Errorf("Unexpected save of %s over a record that could not be read", record.Domain)
+				return nil
+			},
+		},
+		Classifier: verdictOf("opendns", false, "192.0.2.1", nil),
+	}
+
+	// DynamoDB failing says nothing about whether the domain has a record.
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	a.ServeDNS(context.TODO(), rec, r)
+	if rec.Msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected Rcode %d, got %d", dns.RcodeServerFailure, rec.Msg.Rcode)
+	}
+}
@@ -0,0 +1,272 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Classifier decides whether domains are blocked by asking a filtering service.
+type Classifier interface {
+	Classify(ctx context.Context, domain string) (Classification, error)
+}
+
+// Classification is the answer of a filtering service for a domain.
+type Classification struct {
+	// IPs are the addresses the service answered with, keyed by record type.
+	IPs     map[string][]string
+	Blocked bool
+	// CNAMEs are the names the domain is an alias of, in the order of its
+	// CNAME chain.
+	CNAMEs []string
+	// TTL is the lowest TTL of the records the addresses were taken from,
+	// zero if unknown.
+	TTL uint32
+	// Verdicts holds the answer of every provider asked, for auditing.
+	Verdicts []ProviderVerdict
+	// Partial is set when some of the providers asked failed, so the
+	// classification may change once they answer again.
+	Partial bool
+}
+
+// ProviderVerdict is what a single classification provider said about a domain.
+type ProviderVerdict struct {
+	Provider string `json:"provider" dynamodbav:"provider"`
+	Blocked  bool   `json:"blocked" dynamodbav:"blocked"`
+	// Error is set when the provider could not classify the domain.
+	Error string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+}
+
+// Signature recognizes the answers a filtering service gives for blocked domains.
+type Signature struct {
+	// BlockedIPs are the addresses of the service's block pages.
+	BlockedIPs []netip.Addr
+	// NullIPs is set when blocked domains are answered with 0.0.0.0 and ::.
+	NullIPs bool
+	// NXDomainWithoutSOA is set when blocked domains are answered NXDOMAIN
+	// without the SOA record genuine negative answers carry.
+	NXDomainWithoutSOA bool
+}
+
+// blocks reports whether resp is the service's answer for a blocked domain.
+func (s Signature) blocks(resp *dns.Msg) bool {
+	if resp.Rcode == dns.RcodeNameError {
+		if !s.NXDomainWithoutSOA {
+			return false
+		}
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return false
+			}
+		}
+		return true
+	}
+	for _, rr := range resp.Answer {
+		addr, ok := rrAddr(rr)
+		if !ok {
+			continue
+		}
+		if s.NullIPs && addr.IsUnspecified() {
+			return true
+		}
+		for _, blocked := range s.BlockedIPs {
+			if addr == blocked.Unmap() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classifierProvider is a filtering service known by name in the Corefile.
+type classifierProvider struct {
+	servers   []string
+	signature Signature
+}
+
+var classifierProviders = map[string]classifierProvider{
+	"opendns": {
+		servers:   defaultResolvers,
+		signature: Signature{BlockedIPs: addrs(openDNSBlockedIPs...)},
+	},
+	"cloudflare": {
+		// Cloudflare for Families, malware and adult content.
+		servers:   []string{"1.1.1.3:53", "1.0.0.3:53"},
+		signature: Signature{NullIPs: true},
+	},
+	"quad9": {
+		servers:   []string{"9.9.9.9:53", "149.112.112.112:53"},
+		signature: Signature{NXDomainWithoutSOA: true},
+	},
+	"cleanbrowsing": {
+		// CleanBrowsing Family Filter.
+		servers:   []string{"185.228.168.168:53", "185.228.169.168:53"},
+		signature: Signature{BlockedIPs: addrs("185.228.168.10", "2a0d:2a00:1::1")},
+	},
+	"adguard": {
+		servers:   []string{"94.140.14.14:53", "94.140.15.15:53"},
+		signature: Signature{NullIPs: true},
+	},
+}
+
+// DNSClassifier classifies domains by querying the servers of a filtering
+// service and matching its answers against the service's Signature.
+type DNSClassifier struct {
+	// Provider names the service, e.g. "quad9".
+	Provider string
+	// Upstreams are the servers of the service, raced for every lookup.
+	Upstreams *Upstreams
+	Signature Signature
+}
+
+// NewDNSClassifier returns the classifier for the named provider, asking
+// servers instead of the provider's own if any are given.
+func NewDNSClassifier(provider string, servers []string, opts UpstreamOptions) (*DNSClassifier, error) {
+	p, ok := classifierProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown classifier %q, expected one of %s", provider, strings.Join(classifierNames(), ", "))
+	}
+	if len(servers) == 0 {
+		servers = p.servers
+	}
+	return &DNSClassifier{Provider: provider, Upstreams: NewUpstreams(servers, opts), Signature: p.signature}, nil
+}
+
+// Classify looks up the A and AAAA records of domain, racing the servers of
+// the service.
+func (c *DNSClassifier) Classify(ctx context.Context, domain string) (Classification, error) {
+	res, err := race(ctx, c.Upstreams, func(ctx context.Context, s *upstream) (Classification, error) {
+		return c.classify(ctx, s, domain)
+	})
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return Classification{}, err
+		}
+		return Classification{}, fmt.Errorf("failed to classify domain using %s: %w", c.Provider, err)
+	}
+	res.Verdicts = []ProviderVerdict{{Provider: c.Provider, Blocked: res.Blocked}}
+	return res, nil
+}
+
+func (c *DNSClassifier) classify(ctx context.Context, s *upstream, domain string) (Classification, error) {
+	res := Classification{IPs: make(map[string][]string)}
+	var answer []dns.RR
+	var negative *dns.SOA
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := s.query(ctx, domain, qtype)
+		if err != nil {
+			return Classification{}, err
+		}
+		if negative == nil {
+			negative = authority(resp)
+		}
+		if c.Signature.blocks(resp) {
+			res.Blocked = true
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			if res.Blocked {
+				return res, nil
+			}
+			return Classification{}, errNotFound(domain, s.addr, Resolution{SOA: negative}.TTL())
+		default:
+			return Classification{}, errRcode(domain, s.addr, resp.Rcode)
+		}
+		cnames, records := chase(resp, domain, qtype)
+		for _, c := range cnames {
+			answer = append(answer, c)
+			if qtype == dns.TypeA {
+				res.CNAMEs = append(res.CNAMEs, strings.ToLower(strings.TrimSuffix(c.Target, ".")))
+			}
+		}
+		for _, rr := range records {
+			answer = append(answer, rr)
+			if addr, ok := rrAddr(rr); ok {
+				res.IPs[dns.TypeToString[qtype]] = append(res.IPs[dns.TypeToString[qtype]], addr.String())
+			}
+		}
+	}
+	res.TTL = minTTL(answer)
+	if len(res.IPs) == 0 && negative != nil {
+		// NODATA, cacheable for the negative caching TTL of RFC 2308.
+		res.TTL = minTTL(append(answer, negative), negative.Minttl)
+	}
+	return res, nil
+}
+
+// rrAddr returns the address held by an A or AAAA record.
+func rrAddr(rr dns.RR) (netip.Addr, bool) {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return netip.Addr{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+func addrs(ips ...string) []netip.Addr {
+	var res []netip.Addr
+	for _, ip := range ips {
+		res = append(res, netip.MustParseAddr(ip).Unmap())
+	}
+	return res
+}
+
+func classifierNames() []string {
+	var names []string
+	for name := range classifierProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// classifierConfig is a classifier as configured in the Corefile.
+type classifierConfig struct {
+	provider string
+	servers  []string
+	weight   float64
+}
+
+// parseClassifier parses "PROVIDER [ADDRESS...] [weight WEIGHT]".
+func parseClassifier(args []string) (classifierConfig, error) {
+	if len(args) == 0 {
+		return classifierConfig{}, fmt.Errorf("classifier needs a provider")
+	}
+	if _, ok := classifierProviders[args[0]]; !ok {
+		return classifierConfig{}, fmt.Errorf("unknown classifier %q, expected one of %s", args[0], strings.Join(classifierNames(), ", "))
+	}
+	cc := classifierConfig{provider: args[0], weight: 1}
+	args = args[1:]
+	if n := len(args); n >= 2 && args[n-2] == "weight" {
+		weight, err := strconv.ParseFloat(args[n-1], 64)
+		if err != nil || weight <= 0 {
+			return classifierConfig{}, fmt.Errorf("invalid weight %q for classifier %s", args[n-1], cc.provider)
+		}
+		cc.weight = weight
+		args = args[:n-2]
+	}
+	if len(args) == 0 {
+		return cc, nil
+	}
+	servers, err := parseUpstreams(args)
+	if err != nil {
+		return classifierConfig{}, err
+	}
+	cc.servers = servers
+	return cc, nil
+}
@@ -0,0 +1,240 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// newUpstream starts a DNS server answering every query with the rcode, answer
+// and authority records returned by answer.
+func newUpstream(t *testing.T, answer func(q dns.Question) (int, []dns.RR, []dns.RR)) *dnstest.Server {
+	t.Helper()
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Rcode, m.Answer, m.Ns = answer(r.Question[0])
+		w.WriteMsg(m)
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDNSClassifier_Classify(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    string
+		answer      func(q dns.Question) (int, []dns.RR, []dns.RR)
+		expected    Classification
+		expectedErr bool
+		notFound    bool
+	}{
+		{
+			name:     "OpenDNS Allowed",
+			provider: "opendns",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				if q.Qtype == dns.TypeA {
+					return dns.RcodeSuccess, []dns.RR{test.A(q.Name + " 60 IN A 192.0.2.1")}, nil
+				}
+				return dns.RcodeSuccess, nil, []dns.RR{test.SOA(q.Name + " 60 IN SOA ns. host. 1 2 3 4 5")}
+			},
+			expected: Classification{IPs: map[string][]string{"A": {"192.0.2.1"}}, TTL: 60},
+		},
+		{
+			name:     "OpenDNS Blocked",
+			provider: "opendns",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				if q.Qtype == dns.TypeA {
+					return dns.RcodeSuccess, []dns.RR{test.A(q.Name + " 60 IN A 146.112.61.106")}, nil
+				}
+				return dns.RcodeSuccess, []dns.RR{test.AAAA(q.Name + " 60 IN AAAA ::ffff:146.112.61.104")}, nil
+			},
+			expected: Classification{IPs: map[string][]string{"A": {"146.112.61.106"}, "AAAA": {"146.112.61.104"}}, Blocked: true, TTL: 60},
+		},
+		{
+			name:     "Cloudflare Blocked",
+			provider: "cloudflare",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				if q.Qtype == dns.TypeA {
+					return dns.RcodeSuccess, []dns.RR{test.A(q.Name + " 60 IN A 0.0.0.0")}, nil
+				}
+				return dns.RcodeSuccess, []dns.RR{test.AAAA(q.Name + " 60 IN AAAA ::")}, nil
+			},
+			expected: Classification{IPs: map[string][]string{"A": {"0.0.0.0"}, "AAAA": {"::"}}, Blocked: true, TTL: 60},
+		},
+		{
+			name:     "Quad9 Blocked",
+			provider: "quad9",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				return dns.RcodeNameError, nil, nil
+			},
+			expected: Classification{IPs: map[string][]string{}, Blocked: true},
+		},
+		{
+			name:     "Quad9 Not Found",
+			provider: "quad9",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				return dns.RcodeNameError, nil, []dns.RR{test.SOA("example. 60 IN SOA ns. host. 1 2 3 4 5")}
+			},
+			expectedErr: true,
+			notFound:    true,
+		},
+		{
+			name:     "AdGuard Not Found Without SOA",
+			provider: "adguard",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				return dns.RcodeNameError, nil, nil
+			},
+			expectedErr: true,
+			notFound:    true,
+		},
+		{
+			name:     "CleanBrowsing Blocked",
+			provider: "cleanbrowsing",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				if q.Qtype == dns.TypeA {
+					return dns.RcodeSuccess, []dns.RR{test.A(q.Name + " 60 IN A 185.228.168.10")}, nil
+				}
+				return dns.RcodeSuccess, nil, nil
+			},
+			expected: Classification{IPs: map[string][]string{"A": {"185.228.168.10"}}, Blocked: true, TTL: 60},
+		},
+		{
+			name:     "OpenDNS Alias",
+			provider: "opendns",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				alias := test.CNAME(q.Name + " 30 IN CNAME Edge.Example.net.")
+				if q.Qtype == dns.TypeA {
+					return dns.RcodeSuccess, []dns.RR{alias, test.A("edge.example.net. 60 IN A 192.0.2.1")}, nil
+				}
+				return dns.RcodeSuccess, []dns.RR{alias}, nil
+			},
+			expected: Classification{IPs: map[string][]string{"A": {"192.0.2.1"}}, CNAMEs: []string{"edge.example.net"}, TTL: 30},
+		},
+		{
+			name:     "Server Failure",
+			provider: "cloudflare",
+			answer: func(q dns.Question) (int, []dns.RR, []dns.RR) {
+				return dns.RcodeServerFailure, nil, nil
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUpstream(t, tt.answer)
+			c, err := NewDNSClassifier(tt.provider, []string{s.Addr}, UpstreamOptions{Stagger: defaultStagger})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := c.Classify(context.TODO(), "example.com")
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("Expected an error, but got none")
+				}
+				var dnsErr *net.DNSError
+				if notFound := errors.As(err, &dnsErr) && dnsErr.IsNotFound; notFound != tt.notFound {
+					t.Errorf("Expected not found %t, got error %v", tt.notFound, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+			tt.expected.Verdicts = []ProviderVerdict{{Provider: tt.provider, Blocked: tt.expected.Blocked}}
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Errorf("Expected classification %+v, got %+v", tt.expected, res)
+			}
+		})
+	}
+}
+
+func TestDNSClassifier_Failover(t *testing.T) {
+	failing := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		return dns.RcodeRefused, nil, nil
+	})
+	working := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		if q.Qtype == dns.TypeA {
+			return dns.RcodeSuccess, []dns.RR{test.A(q.Name + " 60 IN A 192.0.2.2")}, nil
+		}
+		return dns.RcodeSuccess, nil, nil
+	})
+
+	c, err := NewDNSClassifier("quad9", []string{failing.Addr, working.Addr}, UpstreamOptions{Stagger: defaultStagger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Classify(context.TODO(), "example.com")
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if res.Blocked || !reflect.DeepEqual(res.IPs, map[string][]string{"A": {"192.0.2.2"}}) {
+		t.Errorf("Expected the answer of the second server, got %+v", res)
+	}
+}
+
+func TestNewClassifier(t *testing.T) {
+	tests := []struct {
+		name              string
+		cfg               *config
+		expectedProvider  string
+		expectedServers   []string
+		expectedResolvers []string
+	}{
+		{
+			name:              "Defaults",
+			cfg:               newConfig(),
+			expectedProvider:  "opendns",
+			expectedServers:   defaultResolvers,
+			expectedResolvers: defaultResolvers,
+		},
+		{
+			name:              "Resolver Only",
+			cfg:               &config{resolvers: []string{"192.0.2.53:53"}},
+			expectedProvider:  "opendns",
+			expectedServers:   []string{"192.0.2.53:53"},
+			expectedResolvers: []string{"192.0.2.53:53"},
+		},
+		{
+			name:              "Classifier Only",
+			cfg:               &config{classifiers: []classifierConfig{{provider: "quad9", weight: 1}}},
+			expectedProvider:  "quad9",
+			expectedServers:   []string{"9.9.9.9:53", "149.112.112.112:53"},
+			expectedResolvers: []string{"9.9.9.9:53", "149.112.112.112:53"},
+		},
+		{
+			name:              "Both",
+			cfg:               &config{classifiers: []classifierConfig{{provider: "cloudflare", servers: []string{"1.1.1.3:53"}, weight: 1}}, resolvers: []string{"192.0.2.53:53"}},
+			expectedProvider:  "cloudflare",
+			expectedServers:   []string{"1.1.1.3:53"},
+			expectedResolvers: []string{"192.0.2.53:53"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, resolver, err := newClassifier(tt.cfg)
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+			classifier, ok := c.(*DNSClassifier)
+			if !ok {
+				t.Fatalf("Expected a single classifier, got %T", c)
+			}
+			if classifier.Provider != tt.expectedProvider || !reflect.DeepEqual(classifier.Upstreams.Addrs(), tt.expectedServers) {
+				t.Errorf("Expected classifier %s %v, got %s %v", tt.expectedProvider, tt.expectedServers, classifier.Provider, classifier.Upstreams.Addrs())
+			}
+			if !reflect.DeepEqual(resolver.Upstreams.Addrs(), tt.expectedResolvers) {
+				t.Errorf("Expected resolvers %v, got %v", tt.expectedResolvers, resolver.Upstreams.Addrs())
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package ainaa
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Sources of a client identity.
+const (
+	clientSourceIP   = "ip"
+	clientSourceEDNS = "edns"
+	clientSourceMAC  = "mac"
+	clientSourceDoH  = "doh"
+	clientSourceSNI  = "sni"
+)
+
+// macOptionCode is the EDNS0 option dnsmasq forwards the client's MAC address
+// in (--add-mac).
+const macOptionCode = 65001
+
+// loopback are the networks EDNS0 client IDs are trusted from by default: a
+// forwarder such as dnsmasq running on the same host.
+var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// Client is the identity of the device a query comes from.
+type Client struct {
+	Addr netip.Addr
+	// ID is the identifier the device sent, if any, and Source where it was
+	// found; Source is "ip" for clients only known by their address.
+	ID     string
+	Source string
+}
+
+// String returns the ID of the client, or its address when it has none.
+func (c Client) String() string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return c.Addr.String()
+}
+
+// ClientIdentifier finds the ID of a client in its queries.
+type ClientIdentifier struct {
+	// Source is one of "edns", "mac", "doh" or "sni".
+	Source string
+	// Code is the EDNS0 option holding the ID, for "edns".
+	Code uint16
+	// Zone is the name the ID is the leftmost label of, for "sni".
+	Zone string
+	// From are the networks of the forwarders trusted to add EDNS0 IDs, for
+	// "edns" and "mac"; the loopback networks if empty. Any client can send
+	// these options, IDs from other addresses are ignored.
+	From []netip.Prefix
+}
+
+// trusts reports whether the EDNS0 options of queries from addr are trusted.
+func (ci ClientIdentifier) trusts(addr netip.Addr) bool {
+	from := ci.From
+	if len(from) == 0 {
+		from = loopback
+	}
+	for _, prefix := range from {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// identify returns the ID the identifier finds in the request from addr, if
+// any.
+func (ci ClientIdentifier) identify(ctx context.Context, state request.Request, addr netip.Addr) string {
+	switch ci.Source {
+	case clientSourceEDNS:
+		if !ci.trusts(addr) {
+			return ""
+		}
+		return optionText(state.Req, ci.Code)
+	case clientSourceMAC:
+		if !ci.trusts(addr) {
+			return ""
+		}
+		data := optionData(state.Req, macOptionCode)
+		if len(data) == 6 {
+			return net.HardwareAddr(data).String()
+		}
+		return printable(data)
+	case clientSourceDoH:
+		if r := httpRequest(ctx); r != nil {
+			return dohClientID(r.URL.Path)
+		}
+	case clientSourceSNI:
+		sni := strings.ToLower(strings.TrimSuffix(serverName(ctx, state.W), "."))
+		if id, ok := strings.CutSuffix(sni, "."+ci.Zone); ok && !strings.Contains(id, ".") {
+			return id
+		}
+	}
+	return ""
+}
+
+// identify returns the identity of the client sending the request, the ID
+// found by the first identifier that finds one.
+func (a Ainaa) identify(ctx context.Context, state request.Request) Client {
+	client := Client{Source: clientSourceIP}
+	if addr, err := netip.ParseAddr(state.IP()); err == nil {
+		client.Addr = addr.WithZone("").Unmap()
+	}
+	for _, ci := range a.ClientIdentifiers {
+		if id := ci.identify(ctx, state, client.Addr); id != "" {
+			client.ID, client.Source = id, ci.Source
+			break
+		}
+	}
+	return client
+}
+
+// httpRequest returns the HTTP request of a DoH query, nil for other queries.
+// It is read from the context as the writer may be wrapped by the plugins
+// before this one.
+func httpRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(dnsserver.HTTPRequestKey{}).(*http.Request)
+	return r
+}
+
+// serverName returns the TLS server name the client asked for, over DoT or DoH.
+func serverName(ctx context.Context, w dns.ResponseWriter) string {
+	var cs *tls.ConnectionState
+	if r := httpRequest(ctx); r != nil {
+		cs = r.TLS
+	}
+	// Plugins such as log and prometheus wrap the writer in a recorder.
+	for cs == nil && w != nil {
+		if stater, ok := w.(dns.ConnectionStater); ok {
+			cs = stater.ConnectionState()
+			break
+		}
+		rec, ok := w.(*dnstest.Recorder)
+		if !ok {
+			break
+		}
+		w = rec.ResponseWriter
+	}
+	if cs == nil {
+		return ""
+	}
+	return cs.ServerName
+}
+
+func optionData(r *dns.Msg, code uint16) []byte {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == code {
+			return local.Data
+		}
+	}
+	return nil
+}
+
+// optionText returns the data of the EDNS0 option code as text, in hex if it
+// is binary.
+func optionText(r *dns.Msg, code uint16) string {
+	data := optionData(r, code)
+	if id := printable(data); id != "" || len(data) == 0 {
+		return id
+	}
+	return hex.EncodeToString(data)
+}
+
+// printable returns data as a string if it only holds printable ASCII
+// characters other than space.
+func printable(data []byte) string {
+	for _, b := range data {
+		if b <= ' ' || b > '~' {
+			return ""
+		}
+	}
+	return string(data)
+}
+
+// parseClientIdentifier parses "edns CODE [from NETWORK...]",
+// "mac [from NETWORK...]", "doh" or "sni ZONE".
+func parseClientIdentifier(args []string) (ClientIdentifier, error) {
+	if len(args) == 0 {
+		return ClientIdentifier{}, fmt.Errorf("client_id needs a source")
+	}
+	ci := ClientIdentifier{Source: args[0]}
+	args = args[1:]
+	if ci.Source == clientSourceEDNS || ci.Source == clientSourceMAC {
+		var err error
+		if args, ci.From, err = parseFrom(args); err != nil {
+			return ClientIdentifier{}, err
+		}
+	}
+	switch ci.Source {
+	case clientSourceEDNS:
+		if len(args) != 1 {
+			return ClientIdentifier{}, fmt.Errorf("client_id edns needs an option code")
+		}
+		code, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil || code == 0 {
+			return ClientIdentifier{}, fmt.Errorf("invalid EDNS0 option code %q", args[0])
+		}
+		ci.Code = uint16(code)
+	case clientSourceSNI:
+		if len(args) != 1 {
+			return ClientIdentifier{}, fmt.Errorf("client_id sni needs a zone")
+		}
+		zone, err := normalizeDomain(args[0])
+		if err != nil {
+			return ClientIdentifier{}, err
+		}
+		ci.Zone = zone
+	case clientSourceMAC, clientSourceDoH:
+		if len(args) != 0 {
+			return ClientIdentifier{}, fmt.Errorf("client_id %s takes no arguments", ci.Source)
+		}
+	default:
+		return ClientIdentifier{}, fmt.Errorf("unknown client_id source %q", ci.Source)
+	}
+	return ci, nil
+}
+
+// parseFrom splits "from NETWORK..." off the end of args, returning the
+// arguments before it and the networks.
+func parseFrom(args []string) ([]string, []netip.Prefix, error) {
+	i := slices.Index(args, "from")
+	if i < 0 {
+		return args, nil, nil
+	}
+	if i == len(args)-1 {
+		return nil, nil, fmt.Errorf("client_id from needs a network")
+	}
+	var from []netip.Prefix
+	for _, s := range args[i+1:] {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid network %q: %v", s, err)
+		}
+		from = append(from, prefix)
+	}
+	return args[:i], from, nil
+}
+
+// dohClientID returns the client ID in a DoH request path such as
+// "/dns-query/ID".
+func dohClientID(path string) string {
+	id, ok := strings.CutPrefix(path, doh.Path+"/")
+	if !ok || strings.Contains(id, "/") {
+		return ""
+	}
+	return id
+}
+
+// validateDoHPath accepts DoH requests to the standard path and to the
+// standard path followed by a client ID.
+func validateDoHPath(r *http.Request) bool {
+	return r.URL.Path == doh.Path || dohClientID(r.URL.Path) != ""
+}
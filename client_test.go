@@ -0,0 +1,121 @@
+package ainaa
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+type tlsResponseWriter struct {
+	test.ResponseWriter
+	serverName string
+}
+
+func (w *tlsResponseWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{ServerName: w.serverName}
+}
+
+func TestAinaa_Identify(t *testing.T) {
+	dohRequest := func(path, serverName string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "https://dns.example.com"+path, nil)
+		r.TLS.ServerName = serverName
+		return r
+	}
+	withOption := func(code uint16, data []byte) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code, Data: data})
+		return r
+	}
+
+	forwarders := []netip.Prefix{netip.MustParsePrefix("10.240.0.0/24")}
+	a := Ainaa{ClientIdentifiers: []ClientIdentifier{
+		{Source: clientSourceEDNS, Code: 65073, From: forwarders},
+		{Source: clientSourceMAC, From: forwarders},
+		{Source: clientSourceDoH},
+		{Source: clientSourceSNI, Zone: "dns.example.com"},
+	}}
+
+	tests := []struct {
+		name           string
+		w              dns.ResponseWriter
+		r              *dns.Msg
+		doh            *http.Request
+		identifiers    []ClientIdentifier
+		expectedID     string
+		expectedSource string
+	}{
+		{name: "Address Only", w: &test.ResponseWriter{}, expectedSource: clientSourceIP},
+		{name: "EDNS Text", w: &test.ResponseWriter{}, r: withOption(65073, []byte("kid-tablet")), expectedID: "kid-tablet", expectedSource: clientSourceEDNS},
+		{name: "EDNS Binary", w: &test.ResponseWriter{}, r: withOption(65073, []byte{0xde, 0xad, 0xbe, 0xef}), expectedID: "deadbeef", expectedSource: clientSourceEDNS},
+		{name: "EDNS Other Code", w: &test.ResponseWriter{}, r: withOption(65074, []byte("kid-tablet")), expectedSource: clientSourceIP},
+		{name: "MAC Binary", w: &test.ResponseWriter{}, r: withOption(macOptionCode, []byte{0x02, 0x00, 0x5e, 0x00, 0x53, 0x01}), expectedID: "02:00:5e:00:53:01", expectedSource: clientSourceMAC},
+		{name: "MAC Text", w: &test.ResponseWriter{}, r: withOption(macOptionCode, []byte("02:00:5e:00:53:01")), expectedID: "02:00:5e:00:53:01", expectedSource: clientSourceMAC},
+		{name: "DoH Path", w: &test.ResponseWriter{}, doh: dohRequest("/dns-query/kid-tablet", "dns.example.com"), expectedID: "kid-tablet", expectedSource: clientSourceDoH},
+		{name: "DoH Nested Path", w: &test.ResponseWriter{}, doh: dohRequest("/dns-query/a/b", "dns.example.com"), expectedSource: clientSourceIP},
+		{name: "DoH SNI", w: &test.ResponseWriter{}, doh: dohRequest("/dns-query", "laptop.dns.example.com"), expectedID: "laptop", expectedSource: clientSourceSNI},
+		{name: "DoT SNI", w: &tlsResponseWriter{serverName: "Laptop.DNS.example.com."}, expectedID: "laptop", expectedSource: clientSourceSNI},
+		{name: "DoT SNI Without ID", w: &tlsResponseWriter{serverName: "dns.example.com"}, expectedSource: clientSourceIP},
+		{name: "DoT SNI Other Zone", w: &tlsResponseWriter{serverName: "laptop.example.org"}, expectedSource: clientSourceIP},
+		// Any client can add EDNS0 options, they are only read from trusted forwarders.
+		{name: "EDNS Untrusted", w: &test.ResponseWriter{}, r: withOption(65073, []byte("kid-tablet")), identifiers: []ClientIdentifier{{Source: clientSourceEDNS, Code: 65073, From: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}}, expectedSource: clientSourceIP},
+		{name: "EDNS Untrusted By Default", w: &test.ResponseWriter{}, r: withOption(65073, []byte("kid-tablet")), identifiers: []ClientIdentifier{{Source: clientSourceEDNS, Code: 65073}}, expectedSource: clientSourceIP},
+		{name: "MAC Untrusted By Default", w: &test.ResponseWriter{}, r: withOption(macOptionCode, []byte{0x02, 0x00, 0x5e, 0x00, 0x53, 0x01}), identifiers: []ClientIdentifier{{Source: clientSourceMAC}}, expectedSource: clientSourceIP},
+		// Plugins before this one, such as log, wrap the writer in a recorder.
+		{name: "DoH Path Recorded", w: dnstest.NewRecorder(&test.ResponseWriter{}), doh: dohRequest("/dns-query/kid-tablet", "dns.example.com"), expectedID: "kid-tablet", expectedSource: clientSourceDoH},
+		{name: "DoT SNI Recorded", w: dnstest.NewRecorder(dnstest.NewRecorder(&tlsResponseWriter{serverName: "laptop.dns.example.com"})), expectedID: "laptop", expectedSource: clientSourceSNI},
+		{name: "First Identifier Wins", w: &tlsResponseWriter{serverName: "laptop.dns.example.com"}, r: withOption(65073, []byte("kid-tablet")), expectedID: "kid-tablet", expectedSource: clientSourceEDNS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.r
+			if r == nil {
+				r = new(dns.Msg)
+				r.SetQuestion("example.com.", dns.TypeA)
+			}
+			a := a
+			if tt.identifiers != nil {
+				a.ClientIdentifiers = tt.identifiers
+			}
+			ctx := context.TODO()
+			if tt.doh != nil {
+				ctx = context.WithValue(ctx, dnsserver.HTTPRequestKey{}, tt.doh)
+			}
+			client := a.identify(ctx, request.Request{W: tt.w, Req: r})
+			if client.ID != tt.expectedID || client.Source != tt.expectedSource {
+				t.Errorf("Expected client %q from %s, got %q from %s", tt.expectedID, tt.expectedSource, client.ID, client.Source)
+			}
+			if client.Addr.String() != "10.240.0.1" {
+				t.Errorf("Expected client address 10.240.0.1, got %s", client.Addr)
+			}
+		})
+	}
+}
+
+func TestValidateDoHPath(t *testing.T) {
+	tests := map[string]bool{
+		"/dns-query":            true,
+		"/dns-query/kid-tablet": true,
+		"/dns-query/":           false,
+		"/dns-query/a/b":        false,
+		"/resolve":              false,
+	}
+	for path, expected := range tests {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if got := validateDoHPath(r); got != expected {
+			t.Errorf("Expected %t for %s, got %t", expected, path, got)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Strategy decides from the verdicts of several providers whether a domain
+// is blocked.
+type Strategy int
+
+const (
+	// StrategyAny blocks a domain blocked by any provider.
+	StrategyAny Strategy = iota
+	// StrategyMajority blocks a domain blocked by more than half the providers.
+	StrategyMajority
+	// StrategyWeighted blocks a domain when the weight of the providers
+	// blocking it exceeds Threshold of the total weight.
+	StrategyWeighted
+	// StrategyAll blocks a domain blocked by every provider.
+	StrategyAll
+)
+
+var strategies = map[string]Strategy{
+	"any":      StrategyAny,
+	"majority": StrategyMajority,
+	"weighted": StrategyWeighted,
+	"all":      StrategyAll,
+}
+
+func (s Strategy) String() string {
+	for name, strategy := range strategies {
+		if strategy == s {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// defaultThreshold is the share of the total weight StrategyWeighted needs.
+const defaultThreshold = 0.5
+
+// WeightedClassifier is a classifier taking part in a consensus.
+type WeightedClassifier struct {
+	Classifier Classifier
+	Weight     float64
+}
+
+// Consensus classifies domains by asking several classifiers at once and
+// combining their verdicts with Strategy. Classifiers that fail are left out
+// of the vote, which is then Partial; unless the verdicts of the others
+// already decide it, the consensus fails when half of them or more fail.
+type Consensus struct {
+	Classifiers []WeightedClassifier
+	Strategy    Strategy
+	// Threshold is the share of the total weight needed by StrategyWeighted.
+	Threshold float64
+}
+
+// Classify asks every classifier about domain and combines their verdicts.
+// The addresses are taken from the first classifier that allows the domain,
+// or else from the first one that answered.
+func (c *Consensus) Classify(ctx context.Context, domain string) (Classification, error) {
+	results := make([]Classification, len(c.Classifiers))
+	errs := make([]error, len(c.Classifiers))
+	var wg sync.WaitGroup
+	for i, wc := range c.Classifiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = wc.Classifier.Classify(ctx, domain)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		res                        Classification
+		answered, blocked          int
+		totalWeight, blockedWeight float64
+		missingWeight              float64
+		haveIPs, haveAllowedIPs    bool
+	)
+	for i, wc := range c.Classifiers {
+		if errs[i] != nil {
+			missingWeight += wc.Weight
+			res.Verdicts = append(res.Verdicts, ProviderVerdict{Provider: providerName(wc.Classifier), Error: errs[i].Error()})
+			continue
+		}
+		r := results[i]
+		res.Verdicts = append(res.Verdicts, r.Verdicts...)
+		answered++
+		totalWeight += wc.Weight
+		if r.Blocked {
+			blocked++
+			blockedWeight += wc.Weight
+		}
+		if !haveIPs || (!r.Blocked && !haveAllowedIPs) {
+			res.IPs, res.CNAMEs, res.TTL = r.IPs, r.CNAMEs, r.TTL
+			haveIPs = true
+			haveAllowedIPs = !r.Blocked
+		}
+	}
+
+	// decided is set when the classifiers that failed could not have changed
+	// the verdict whatever they said.
+	var decided bool
+	switch n, weight := len(c.Classifiers), totalWeight+missingWeight; c.Strategy {
+	case StrategyAny:
+		decided = blocked > 0
+	case StrategyMajority:
+		decided = blocked*2 > n || (answered-blocked)*2 >= n
+	case StrategyWeighted:
+		decided = blockedWeight > c.Threshold*weight || blockedWeight+missingWeight <= c.Threshold*weight
+	case StrategyAll:
+		decided = blocked < answered
+	}
+	if answered == 0 || (answered*2 <= len(c.Classifiers) && !decided) {
+		return Classification{}, c.failure(domain, answered, errs)
+	}
+	res.Partial = answered < len(c.Classifiers)
+
+	switch c.Strategy {
+	case StrategyAny:
+		res.Blocked = blocked > 0
+	case StrategyMajority:
+		res.Blocked = blocked*2 > answered
+	case StrategyWeighted:
+		res.Blocked = blockedWeight > c.Threshold*totalWeight
+	case StrategyAll:
+		res.Blocked = blocked == answered
+	}
+	return res, nil
+}
+
+// failure returns the error of a consensus the classifiers could not reach.
+// It only wraps ErrUpstreamsDown when the upstreams of every classifier are
+// down: degrading because one of them is would let a domain others block
+// through.
+func (c *Consensus) failure(domain string, answered int, errs []error) error {
+	var lastErr error
+	down := 0
+	for _, err := range errs {
+		switch {
+		case errors.Is(err, ErrUpstreamsDown):
+			down++
+		case err != nil:
+			lastErr = err
+		}
+	}
+	if down == len(errs) {
+		lastErr = ErrUpstreamsDown
+	}
+	if answered == 0 {
+		return fmt.Errorf("no classifier could classify %s: %w", domain, lastErr)
+	}
+	if lastErr == nil {
+		return fmt.Errorf("only %d of %d classifiers could classify %s, the upstreams of the others are down", answered, len(c.Classifiers), domain)
+	}
+	return fmt.Errorf("only %d of %d classifiers could classify %s: %w", answered, len(c.Classifiers), domain, lastErr)
+}
+
+// providerName returns the name a classifier's verdicts are recorded under.
+func providerName(c Classifier) string {
+	if dc, ok := c.(*DNSClassifier); ok {
+		return dc.Provider
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+// parseStrategy parses "STRATEGY [THRESHOLD]", a threshold being only
+// accepted for the weighted strategy.
+func parseStrategy(args []string) (Strategy, float64, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return 0, 0, fmt.Errorf("consensus needs a strategy")
+	}
+	strategy, ok := strategies[args[0]]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown consensus strategy %q, expected any, majority, weighted or all", args[0])
+	}
+	threshold := defaultThreshold
+	if len(args) == 2 {
+		if strategy != StrategyWeighted {
+			return 0, 0, fmt.Errorf("consensus strategy %s takes no threshold", strategy)
+		}
+		t, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || t <= 0 || t >= 1 {
+			return 0, 0, fmt.Errorf("invalid consensus threshold %q, expected a number between 0 and 1", args[1])
+		}
+		threshold = t
+	}
+	return strategy, threshold, nil
+}
@@ -0,0 +1,115 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type MockClassifier struct {
+	ClassifyFunc func(ctx context.Context, domain string) (Classification, error)
+}
+
+func (m *MockClassifier) Classify(ctx context.Context, domain string) (Classification, error) {
+	return m.ClassifyFunc(ctx, domain)
+}
+
+// verdictOf returns a classifier answering for provider with blocked, or
+// failing if err is set.
+func verdictOf(provider string, blocked bool, ip string, err error) Classifier {
+	return &MockClassifier{ClassifyFunc: func(ctx context.Context, domain string) (Classification, error) {
+		if err != nil {
+			return Classification{}, err
+		}
+		return Classification{
+			IPs:      map[string][]string{"A": {ip}},
+			Blocked:  blocked,
+			Verdicts: []ProviderVerdict{{Provider: provider, Blocked: blocked}},
+		}, nil
+	}}
+}
+
+func TestConsensus_Classify(t *testing.T) {
+	failure := errors.New("timeout")
+	classifiers := []WeightedClassifier{
+		{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 3},
+		{Classifier: verdictOf("opendns", false, "192.0.2.1", nil), Weight: 1},
+		{Classifier: verdictOf("adguard", false, "192.0.2.2", nil), Weight: 1},
+		{Classifier: &DNSClassifier{Provider: "cloudflare", Upstreams: NewUpstreams(nil, UpstreamOptions{})}, Weight: 5},
+	}
+	// The cloudflare classifier has no servers and always fails.
+
+	tests := []struct {
+		name      string
+		strategy  Strategy
+		threshold float64
+		expected  bool
+	}{
+		{name: "Any", strategy: StrategyAny, expected: true},
+		{name: "Majority", strategy: StrategyMajority, expected: false},
+		{name: "Weighted", strategy: StrategyWeighted, threshold: 0.5, expected: true},
+		{name: "Weighted High Threshold", strategy: StrategyWeighted, threshold: 0.6, expected: false},
+		{name: "All", strategy: StrategyAll, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Consensus{Classifiers: classifiers, Strategy: tt.strategy, Threshold: tt.threshold}
+			res, err := c.Classify(context.TODO(), "example.com")
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+			if res.Blocked != tt.expected {
+				t.Errorf("Expected blocked %t, got %t", tt.expected, res.Blocked)
+			}
+			if !res.Partial {
+				t.Errorf("Expected a partial vote without cloudflare")
+			}
+			if !reflect.DeepEqual(res.IPs, map[string][]string{"A": {"192.0.2.1"}}) {
+				t.Errorf("Expected the addresses of the first allowing classifier, got %v", res.IPs)
+			}
+			if len(res.Verdicts) != 4 || res.Verdicts[3].Provider != "cloudflare" || res.Verdicts[3].Error == "" {
+				t.Errorf("Expected 4 verdicts ending with the cloudflare error, got %+v", res.Verdicts)
+			}
+		})
+	}
+
+	c := &Consensus{Classifiers: []WeightedClassifier{
+		{Classifier: verdictOf("quad9", false, "", failure), Weight: 1},
+		{Classifier: verdictOf("opendns", false, "", failure), Weight: 1},
+	}}
+	if _, err := c.Classify(context.TODO(), "example.com"); !errors.Is(err, failure) {
+		t.Errorf("Expected the classifiers' error, got %v", err)
+	}
+
+	// Without a quorum, one provider's verdict is not the consensus.
+	for _, strategy := range []Strategy{StrategyMajority, StrategyAll} {
+		c := &Consensus{Classifiers: []WeightedClassifier{
+			{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 1},
+			{Classifier: verdictOf("opendns", false, "", failure), Weight: 1},
+			{Classifier: verdictOf("adguard", false, "", failure), Weight: 1},
+		}, Strategy: strategy}
+		if _, err := c.Classify(context.TODO(), "example.com"); !errors.Is(err, failure) {
+			t.Errorf("Expected %s to fail without a quorum, got %v", strategy, err)
+		}
+	}
+
+	// A block is the verdict of any whatever the classifiers that are down say.
+	c = &Consensus{Classifiers: []WeightedClassifier{
+		{Classifier: verdictOf("quad9", true, "0.0.0.0", nil), Weight: 1},
+		{Classifier: verdictOf("opendns", false, "", ErrUpstreamsDown), Weight: 1},
+	}, Strategy: StrategyAny}
+	if res, err := c.Classify(context.TODO(), "example.com"); err != nil || !res.Blocked || !res.Partial {
+		t.Errorf("Expected a partial block, got %+v, %v", res, err)
+	}
+
+	// The upstreams are only down if they are for every classifier.
+	c.Classifiers[0].Classifier = verdictOf("quad9", false, "192.0.2.1", nil)
+	if _, err := c.Classify(context.TODO(), "example.com"); err == nil || errors.Is(err, ErrUpstreamsDown) {
+		t.Errorf("Expected an error other than ErrUpstreamsDown, got %v", err)
+	}
+	c.Classifiers[0].Classifier = verdictOf("quad9", false, "", ErrUpstreamsDown)
+	if _, err := c.Classify(context.TODO(), "example.com"); !errors.Is(err, ErrUpstreamsDown) {
+		t.Errorf("Expected ErrUpstreamsDown, got %v", err)
+	}
+}
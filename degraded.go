@@ -0,0 +1,81 @@
+package ainaa
+
+import (
+	"sync"
+)
+
+// DegradedMode is how domains nobody knows yet are answered while every
+// upstream is down.
+type DegradedMode int
+
+const (
+	// DegradedStale answers with the last status the classifier gave for
+	// the domain, and fails domains it never classified.
+	DegradedStale DegradedMode = iota
+	// DegradedAllow fails open, allowing the domain.
+	DegradedAllow
+	// DegradedBlock fails closed, blocking the domain with BlockStatus.
+	DegradedBlock
+)
+
+var degradedModes = map[string]DegradedMode{
+	"stale": DegradedStale,
+	"allow": DegradedAllow,
+	"block": DegradedBlock,
+}
+
+func (m DegradedMode) String() string {
+	for name, mode := range degradedModes {
+		if mode == m {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// defaultLastKnownSize is how many classifications are remembered for
+// DegradedStale.
+const defaultLastKnownSize = 10000
+
+// lastKnown remembers the latest classifications, so they can still be
+// served when neither the upstreams nor the stores can be reached. Once
+// full, the oldest entries are dropped first.
+type lastKnown struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]CachedDomain
+	// order holds the domains in entries, oldest first.
+	order []string
+}
+
+func newLastKnown(size int) *lastKnown {
+	return &lastKnown{size: size, entries: make(map[string]CachedDomain, size)}
+}
+
+// set records rec as the latest classification of domain.
+func (l *lastKnown) set(domain string, rec CachedDomain) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[domain]; !ok {
+		if len(l.order) >= l.size {
+			delete(l.entries, l.order[0])
+			l.order = l.order[1:]
+		}
+		l.order = append(l.order, domain)
+	}
+	l.entries[domain] = rec
+}
+
+// get returns the latest classification of domain.
+func (l *lastKnown) get(domain string) (CachedDomain, bool) {
+	if l == nil {
+		return CachedDomain{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.entries[domain]
+	return rec, ok
+}
@@ -0,0 +1,37 @@
+package ainaa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// domainAndParents returns domain followed by each of its parent domains, most
+// specific first, e.g. "a.b.example.com", "b.example.com", "example.com", "com".
+func domainAndParents(domain string) []string {
+	names := []string{domain}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		domain = domain[i+1:]
+		if domain == "" {
+			break
+		}
+		names = append(names, domain)
+	}
+	return names
+}
+
+// inherits reports whether rec, stored for zone, applies to domain. Records
+// blocking or explicitly allowing a domain apply to its subdomains too unless
+// NoInherit is set; other records only apply to their exact domain.
+func inherits(domain, zone string, rec CachedDomain) bool {
+	return domain == zone || (!rec.NoInherit && (rec.Status != 0 || rec.Allow))
+}
+
+// normalizeDomain lowercases domain and strips its trailing dot.
+func normalizeDomain(domain string) (string, error) {
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "." {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return strings.TrimSuffix(strings.ToLower(domain), "."), nil
+}
@@ -0,0 +1,60 @@
+package ainaa
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DomainList is a set of domains, each matching its subdomains too.
+type DomainList map[string]struct{}
+
+// Add adds domain to the list.
+func (l DomainList) Add(domain string) error {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	l[domain] = struct{}{}
+	return nil
+}
+
+// Match returns the listed name covering domain, if there is one.
+func (l DomainList) Match(domain string) (string, bool) {
+	if len(l) == 0 {
+		return "", false
+	}
+	for _, zone := range domainAndParents(domain) {
+		if _, ok := l[zone]; ok {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// Load adds every domain listed in the file at path, one per line. Empty
+// lines and everything after a '#' are ignored.
+func (l DomainList) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := l.Add(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -2,11 +2,11 @@ package ainaa
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -15,22 +15,31 @@ import (
 // DynamoDBRepository implements PersistentRepository using DynamoDB.
 type DynamoDBRepository struct {
 	client *dynamodb.Client
+	table  string
 }
 
-// NewDynamoDBRepository creates a new DynamoDBRepository.
-func NewDynamoDBRepository(client *dynamodb.Client) *DynamoDBRepository {
-	return &DynamoDBRepository{client: client}
+// NewDynamoDBRepository creates a new DynamoDBRepository backed by the given table.
+func NewDynamoDBRepository(client *dynamodb.Client, table string) *DynamoDBRepository {
+	return &DynamoDBRepository{client: client, table: table}
 }
 
-func connectDynamoDB(ctx context.Context) (*dynamodb.Client, error) {
-
-	// Load AWS config (reads credentials and region from environment or shared config)
-	cfg, err := config.LoadDefaultConfig(ctx)
+func connectDynamoDB(ctx context.Context, cfg *config) (*dynamodb.Client, error) {
+	// Credentials still come from the default AWS chain, region and endpoint
+	// may be overridden from the Corefile.
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.dynamoRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.dynamoRegion))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	client := dynamodb.NewFromConfig(cfg)
+	client := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if cfg.dynamoEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.dynamoEndpoint)
+		}
+	})
 
 	// check the connection with a light call (for readiness)
 	_, err = client.ListTables(ctx, &dynamodb.ListTablesInput{Limit: aws.Int32(1)})
@@ -44,7 +53,7 @@ func connectDynamoDB(ctx context.Context) (*dynamodb.Client, error) {
 // Get retrieves a domain from DynamoDB.
 func (r *DynamoDBRepository) Get(ctx context.Context, domain string) (DomainRecord, error) {
 	val, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
+		TableName: aws.String(r.table),
 		Key: map[string]types.AttributeValue{
 			"domain": &types.AttributeValueMemberS{Value: domain},
 		},
@@ -53,7 +62,7 @@ func (r *DynamoDBRepository) Get(ctx context.Context, domain string) (DomainReco
 		return DomainRecord{}, err
 	}
 	if val.Item == nil {
-		return DomainRecord{}, fmt.Errorf("domain not found")
+		return DomainRecord{}, ErrDomainNotFound
 	}
 
 	var domainRecord DomainRecord
@@ -62,7 +71,7 @@ func (r *DynamoDBRepository) Get(ctx context.Context, domain string) (DomainReco
 	return domainRecord, nil
 }
 
-// Save stores a domain in DynamoDB.
+// Save stores a domain in DynamoDB unless it already has a record.
 func (r *DynamoDBRepository) Save(ctx context.Context, record DomainRecord) error {
 	item, err := attributevalue.MarshalMap(record)
 	if err != nil {
@@ -70,8 +79,46 @@ func (r *DynamoDBRepository) Save(ctx context.Context, record DomainRecord) erro
 	}
 
 	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
+		TableName:                aws.String(r.table),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#domain)"),
+		ExpressionAttributeNames: map[string]string{"#domain": "domain"},
 	})
+	var exists *types.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		// The record stored meanwhile wins.
+		return nil
+	}
 	return err
 }
+
+// DynamoDBProfileRepository implements ProfileRepository using DynamoDB.
+type DynamoDBProfileRepository struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// NewDynamoDBProfileRepository creates a new DynamoDBProfileRepository backed by the given table.
+func NewDynamoDBProfileRepository(client *dynamodb.Client, table string) *DynamoDBProfileRepository {
+	return &DynamoDBProfileRepository{client: client, table: table}
+}
+
+// LoadProfiles reads every profile stored in the table.
+func (r *DynamoDBProfileRepository) LoadProfiles(ctx context.Context) ([]ProfileRecord, error) {
+	var records []ProfileRecord
+	paginator := dynamodb.NewScanPaginator(r.client, &dynamodb.ScanInput{
+		TableName: aws.String(r.table),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var pageRecords []ProfileRecord
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageRecords); err != nil {
+			return nil, err
+		}
+		records = append(records, pageRecords...)
+	}
+	return records, nil
+}
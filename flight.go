@@ -0,0 +1,123 @@
+package ainaa
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls made for the same key, so a domain
+// many clients ask for at once is only looked up once. The nil group runs
+// every call on its own.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+// flightCall is a call in progress and the callers waiting for it.
+type flightCall[T any] struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	val     T
+	err     error
+}
+
+func newFlightGroup[T any]() *flightGroup[T] {
+	return &flightGroup[T]{calls: make(map[string]*flightCall[T])}
+}
+
+// do returns the result of fn for key, joining the call in progress for key
+// if there is one. Every caller waits until its own ctx is done. fn keeps the
+// values and deadline of the ctx of the caller that started it, but is only
+// cancelled once every caller has given up.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(context.Context) (T, error)) (T, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		c = g.start(ctx, key, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.leave(key, c)
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// try starts fn for key in the background unless a call for key is in
+// progress, and reports whether it did. It never waits for fn, which keeps
+// the values and deadline of ctx but is never cancelled by callers joining
+// it and giving up.
+func (g *flightGroup[T]) try(ctx context.Context, key string, fn func(context.Context) (T, error)) bool {
+	if g == nil {
+		fctx, cancel := detach(ctx)
+		go func() {
+			defer cancel()
+			fn(fctx)
+		}()
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.calls[key]; ok {
+		return false
+	}
+	// The caller that started the call never leaves it.
+	g.start(ctx, key, fn).waiters++
+	return true
+}
+
+// start runs fn for key in a call of its own. g.mu must be held.
+func (g *flightGroup[T]) start(ctx context.Context, key string, fn func(context.Context) (T, error)) *flightCall[T] {
+	c := &flightCall[T]{done: make(chan struct{})}
+	fctx, cancel := detach(ctx)
+	c.cancel = cancel
+	g.calls[key] = c
+	go g.run(fctx, key, c, fn)
+	return c
+}
+
+func (g *flightGroup[T]) run(ctx context.Context, key string, c *flightCall[T], fn func(context.Context) (T, error)) {
+	c.val, c.err = fn(ctx)
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	close(c.done)
+	c.cancel()
+}
+
+// leave removes a caller that gave up from c, cancelling the call when it
+// was the last one. Later callers start a call of their own.
+func (g *flightGroup[T]) leave(key string, c *flightCall[T]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.waiters--
+	if c.waiters > 0 {
+		return
+	}
+	c.cancel()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// detach returns a context with the values and deadline of ctx that is only
+// cancelled by the returned function.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
+}
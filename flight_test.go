@@ -0,0 +1,154 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n callers wait for the call in progress for key.
+func waitForWaiters[T any](t *testing.T, g *flightGroup[T], key string, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		c, ok := g.calls[key]
+		waiting := ok && c.waiters == n
+		g.mu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatalf("Expected %d callers waiting for %s", n, key)
+}
+
+func TestFlightGroup_Do(t *testing.T) {
+	g := newFlightGroup[int]()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make([]int, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = g.do(context.TODO(), "example.com", fn)
+		}()
+	}
+	waitForWaiters(t, g, "example.com", callers)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 call, got %d", n)
+	}
+	for _, res := range results {
+		if res != 42 {
+			t.Errorf("Expected every caller to get 42, got %v", results)
+			break
+		}
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("Expected the call forgotten once done, got %v", g.calls)
+	}
+}
+
+func TestFlightGroup_Cancel(t *testing.T) {
+	g := newFlightGroup[int]()
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		select {
+		case <-release:
+			return 42, nil
+		case <-ctx.Done():
+			close(cancelled)
+			return 0, ctx.Err()
+		}
+	}
+
+	// The caller that started the call goes away, the other still gets the result.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := g.do(ctx, "example.com", fn)
+		first <- err
+	}()
+	waitForWaiters(t, g, "example.com", 1)
+	second := make(chan int)
+	go func() {
+		res, _ := g.do(context.Background(), "example.com", fn)
+		second <- res
+	}()
+	waitForWaiters(t, g, "example.com", 2)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the first caller cancelled, got %v", err)
+	}
+	close(release)
+	if res := <-second; res != 42 {
+		t.Errorf("Expected the second caller to get 42, got %d", res)
+	}
+
+	// Once every caller went away, the call is cancelled.
+	release = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go g.do(ctx, "example.org", fn)
+	waitForWaiters(t, g, "example.org", 1)
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the call cancelled")
+	}
+}
+
+func TestFlightGroup_Try(t *testing.T) {
+	g := newFlightGroup[int]()
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		done <- ctx.Err()
+		return 42, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !g.try(ctx, "example.com", fn) {
+		t.Fatalf("Expected the call started")
+	}
+	// The call outlives the ctx it was started with.
+	cancel()
+	// Duplicates are dropped rather than left waiting.
+	for range 10 {
+		if g.try(context.Background(), "example.com", fn) {
+			t.Errorf("Expected the duplicate call dropped")
+		}
+	}
+	// A caller joining the call and giving up does not cancel it.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	g.do(ctx, "example.com", fn)
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the call not cancelled, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 call, got %d", n)
+	}
+}
@@ -0,0 +1,159 @@
+package ainaa
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+// PrefixList is a set of address ranges, such as known bad hosting ranges or
+// the addresses of a threat intelligence feed.
+type PrefixList []netip.Prefix
+
+// Add adds prefix, in CIDR notation or a single address, to the list.
+func (l *PrefixList) Add(prefix string) error {
+	if !strings.Contains(prefix, "/") {
+		addr, err := netip.ParseAddr(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", prefix)
+		}
+		addr = addr.Unmap()
+		*l = append(*l, netip.PrefixFrom(addr, addr.BitLen()))
+		return nil
+	}
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix %q", prefix)
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	*l = append(*l, p.Masked())
+	return nil
+}
+
+// Load adds every prefix listed in the file at path, one per line. Empty
+// lines and everything after a '#' are ignored.
+func (l *PrefixList) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := l.Add(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Match returns the listed prefix containing addr, if there is one.
+// IPv4-mapped IPv6 addresses match the IPv4 prefixes.
+func (l PrefixList) Match(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// MatchIPs returns the listed prefix containing one of ips, addresses keyed
+// by record type.
+func (l PrefixList) MatchIPs(ips map[string][]string) (netip.Prefix, bool) {
+	for _, addrs := range ips {
+		for _, ip := range addrs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				continue
+			}
+			if p, ok := l.Match(addr); ok {
+				return p, true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// mustPrefixList returns the list of prefixes, panicking on invalid ones.
+func mustPrefixList(prefixes ...string) PrefixList {
+	var l PrefixList
+	for _, p := range prefixes {
+		if err := l.Add(p); err != nil {
+			panic(err)
+		}
+	}
+	return l
+}
+
+// IPAction is what is done with answers holding addresses of the IP blocklist.
+type IPAction int
+
+const (
+	// IPActionBlock blocks the whole answer, as if the domain were blocked
+	// with BlockStatus.
+	IPActionBlock IPAction = iota
+	// IPActionStrip removes the listed addresses from the answer, leaving
+	// the others.
+	IPActionStrip
+)
+
+var ipActions = map[string]IPAction{
+	"block": IPActionBlock,
+	"strip": IPActionStrip,
+}
+
+func (a IPAction) String() string {
+	for name, action := range ipActions {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// filterAddresses checks the addresses resolved for domain against the IP
+// blocklist. Listed addresses are stripped from res, or else the verdict
+// blocking domain is returned.
+func (a Ainaa) filterAddresses(domain string, res *Resolution) (verdict, bool) {
+	if len(a.IPBlocklist) == 0 {
+		return verdict{}, false
+	}
+	var kept []dns.RR
+	for _, rr := range res.Records {
+		addr, ok := rrAddr(rr)
+		if !ok {
+			kept = append(kept, rr)
+			continue
+		}
+		p, listed := a.IPBlocklist.Match(addr)
+		if !listed {
+			kept = append(kept, rr)
+			continue
+		}
+		if a.IPAction == IPActionBlock {
+			log.Debugf("Domain %s resolves to %s in %s, blocking", domain, addr, p)
+			return verdict{zone: domain, status: a.BlockStatus, source: sourceIPBlocklist}, true
+		}
+		log.Debugf("Domain %s resolves to %s in %s, stripping it", domain, addr, p)
+	}
+	res.Records = kept
+	return verdict{}, false
+}
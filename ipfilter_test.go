@@ -0,0 +1,68 @@
+package ainaa
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrefixList_Match(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	content := "# bad hosting\n203.0.113.0/24\n\n2001:db8:bad::/48 # feed\n198.51.100.7\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var l PrefixList
+	if err := l.Load(path); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{addr: "203.0.113.42", expected: "203.0.113.0/24"},
+		{addr: "::ffff:203.0.113.42", expected: "203.0.113.0/24"},
+		{addr: "2001:db8:bad:1::1", expected: "2001:db8:bad::/48"},
+		{addr: "198.51.100.7", expected: "198.51.100.7/32"},
+		{addr: "198.51.100.8"},
+		{addr: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			p, ok := l.Match(netip.MustParseAddr(tt.addr))
+			if tt.expected == "" {
+				if ok {
+					t.Errorf("Expected no match, got %s", p)
+				}
+				return
+			}
+			if !ok || p.String() != tt.expected {
+				t.Errorf("Expected %s, got %s (%t)", tt.expected, p, ok)
+			}
+		})
+	}
+}
+
+func TestPrefixList_LoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.txt")
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\nnot-an-ip\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var l PrefixList
+	if err := l.Load(path); err == nil {
+		t.Errorf("Expected an error, but got none")
+	}
+}
+
+func TestOpenDNSResolver_IsBlockedDomain(t *testing.T) {
+	r := &OpenDNSResolver{}
+	if !r.IsBlockedDomain(map[string][]string{"AAAA": {"::ffff:146.112.61.106"}}) {
+		t.Errorf("Expected a mapped block page address to be recognized")
+	}
+	if r.IsBlockedDomain(map[string][]string{"A": {"192.0.2.1"}}) {
+		t.Errorf("Expected other addresses not to be blocked")
+	}
+}
@@ -0,0 +1,149 @@
+package ainaa
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMemoryCacheSize is how many domains are kept in process memory
+	// when memory_cache is given without a size.
+	defaultMemoryCacheSize = 10000
+	// defaultMemoryCacheTTL is how long domains are kept in process memory.
+	defaultMemoryCacheTTL = 1 * time.Minute
+	// memoryCacheShards is the number of independently locked parts of the
+	// memory cache, so concurrent queries rarely wait for each other.
+	memoryCacheShards = 16
+)
+
+// MemoryCache is a CacheRepository keeping the most recently used domains in
+// process memory in front of another CacheRepository, so hot domains are
+// answered without a round trip. Writes go to both.
+type MemoryCache struct {
+	next   CacheRepository
+	ttl    time.Duration
+	seed   maphash.Seed
+	shards [memoryCacheShards]*cacheShard
+
+	// now returns the time entries expire against, time.Now if nil.
+	now func() time.Time
+}
+
+// NewMemoryCache returns a cache of at most size domains, each kept for at
+// most ttl, in front of next.
+func NewMemoryCache(next CacheRepository, size int, ttl time.Duration) *MemoryCache {
+	m := &MemoryCache{next: next, ttl: ttl, seed: maphash.MakeSeed()}
+	perShard := max(1, (size+memoryCacheShards-1)/memoryCacheShards)
+	for i := range m.shards {
+		m.shards[i] = &cacheShard{size: perShard, entries: make(map[string]*list.Element)}
+	}
+	return m
+}
+
+// Get returns the domain from memory or else from the next cache, keeping it
+// in memory for next time.
+func (m *MemoryCache) Get(ctx context.Context, domain string) (CachedDomain, error) {
+	shard := m.shard(domain)
+	now := m.clock()
+	if value, ok := shard.get(domain, now); ok {
+		return value, nil
+	}
+	value, err := m.next.Get(ctx, domain)
+	if err != nil {
+		return CachedDomain{}, err
+	}
+	shard.set(domain, value, m.expiry(value, now, m.ttl), now)
+	return value, nil
+}
+
+// Set stores the domain in memory and in the next cache. It is kept in
+// memory no longer than in the next cache.
+func (m *MemoryCache) Set(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+	now := m.clock()
+	m.shard(domain).set(domain, value, m.expiry(value, now, min(ttl, m.ttl)), now)
+	return m.next.Set(ctx, domain, value, ttl)
+}
+
+// expiry returns when value, stored at now, leaves memory: after ttl, or
+// as soon as its decision or its addresses expire, so the next cache is
+// asked again for fresher ones.
+func (m *MemoryCache) expiry(value CachedDomain, now time.Time, ttl time.Duration) time.Time {
+	expires := now.Add(ttl)
+	for _, t := range []int64{value.Expires, value.IPsExpire} {
+		if t != 0 && time.Unix(t, 0).Before(expires) {
+			expires = time.Unix(t, 0)
+		}
+	}
+	return expires
+}
+
+func (m *MemoryCache) shard(domain string) *cacheShard {
+	return m.shards[maphash.String(m.seed, domain)%memoryCacheShards]
+}
+
+func (m *MemoryCache) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// cacheShard is a part of the memory cache, evicting its least recently used
+// domain once full.
+type cacheShard struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// lru holds the entries, most recently used first.
+	lru list.List
+}
+
+type cacheEntry struct {
+	domain  string
+	value   CachedDomain
+	expires time.Time
+}
+
+func (s *cacheShard) get(domain string, now time.Time) (CachedDomain, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[domain]
+	if !ok {
+		return CachedDomain{}, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		s.lru.Remove(e)
+		delete(s.entries, domain)
+		return CachedDomain{}, false
+	}
+	s.lru.MoveToFront(e)
+	return entry.value, true
+}
+
+func (s *cacheShard) set(domain string, value CachedDomain, expires time.Time, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !expires.After(now) {
+		// Expired already, such as a stale entry; don't keep it.
+		if e, ok := s.entries[domain]; ok {
+			s.lru.Remove(e)
+			delete(s.entries, domain)
+		}
+		return
+	}
+	if e, ok := s.entries[domain]; ok {
+		e.Value = &cacheEntry{domain: domain, value: value, expires: expires}
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.entries[domain] = s.lru.PushFront(&cacheEntry{domain: domain, value: value, expires: expires})
+	if s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).domain)
+	}
+}
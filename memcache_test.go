@@ -0,0 +1,119 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	stored := map[string]CachedDomain{"redis.example": {Status: 2}}
+	var gets, sets int
+	next := &MockCacheRepository{
+		GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+			gets++
+			if v, ok := stored[domain]; ok {
+				return v, nil
+			}
+			return CachedDomain{}, errors.New("miss")
+		},
+		SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+			sets++
+			stored[domain] = value
+			return nil
+		},
+	}
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+	m := NewMemoryCache(next, memoryCacheShards, time.Minute)
+	m.now = func() time.Time { return now }
+	ctx := context.TODO()
+
+	if _, err := m.Get(ctx, "missing.example"); err == nil {
+		t.Errorf("Expected a miss, but got none")
+	}
+	for range 2 {
+		if v, err := m.Get(ctx, "redis.example"); err != nil || v.Status != 2 {
+			t.Fatalf("Expected status 2, got %+v, %v", v, err)
+		}
+	}
+	if gets != 2 {
+		t.Errorf("Expected the second lookup answered from memory, got %d lookups in the next cache", gets)
+	}
+
+	if err := m.Set(ctx, "new.example", CachedDomain{Status: 1}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sets != 1 || stored["new.example"].Status != 1 {
+		t.Errorf("Expected the write to go through to the next cache")
+	}
+	if v, err := m.Get(ctx, "new.example"); err != nil || v.Status != 1 || gets != 2 {
+		t.Errorf("Expected status 1 from memory, got %+v, %v after %d lookups", v, err, gets)
+	}
+
+	// Entries live no longer than in the next cache.
+	now = now.Add(10 * time.Second)
+	m.Get(ctx, "new.example")
+	if gets != 3 {
+		t.Errorf("Expected the expired entry looked up again, got %d lookups", gets)
+	}
+	now = now.Add(time.Minute)
+	m.Get(ctx, "redis.example")
+	if gets != 4 {
+		t.Errorf("Expected the expired entry looked up again, got %d lookups", gets)
+	}
+
+	// Entries live no longer than their decision or addresses, whatever is
+	// left of the TTL of the memory cache.
+	stored["failed.example"] = CachedDomain{Negative: negativeServfail, Expires: now.Add(5 * time.Second).Unix()}
+	stored["addresses.example"] = CachedDomain{IPs: map[string][]string{"A": {"192.0.2.1"}}, IPsExpire: now.Add(5 * time.Second).Unix()}
+	stored["stale.example"] = CachedDomain{Expires: now.Add(-time.Second).Unix()}
+	for _, domain := range []string{"failed.example", "addresses.example", "stale.example"} {
+		m.Get(ctx, domain)
+		before := gets
+		m.Get(ctx, domain)
+		if domain != "stale.example" && gets != before {
+			t.Errorf("Expected %s answered from memory, got %d lookups", domain, gets)
+		}
+		if domain == "stale.example" && gets == before {
+			t.Errorf("Expected the expired %s not kept in memory", domain)
+		}
+		now = now.Add(5 * time.Second)
+		before = gets
+		m.Get(ctx, domain)
+		if gets == before {
+			t.Errorf("Expected %s looked up again once expired", domain)
+		}
+		now = now.Add(-5 * time.Second)
+	}
+}
+
+func TestMemoryCache_Evict(t *testing.T) {
+	next := &MockCacheRepository{
+		GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+			return CachedDomain{}, errors.New("miss")
+		},
+		SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error { return nil },
+	}
+	// Two entries per shard.
+	m := NewMemoryCache(next, 2*memoryCacheShards, time.Minute)
+	shard := m.shards[0]
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	shard.set("a.example", CachedDomain{Status: 1}, expires, now)
+	shard.set("b.example", CachedDomain{Status: 2}, expires, now)
+	shard.get("a.example", now)
+	shard.set("c.example", CachedDomain{Status: 3}, expires, now)
+
+	if shard.lru.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", shard.lru.Len())
+	}
+	if _, ok := shard.get("b.example", time.Now()); ok {
+		t.Errorf("Expected the least recently used entry evicted")
+	}
+	for _, domain := range []string{"a.example", "c.example"} {
+		if _, ok := shard.get(domain, time.Now()); !ok {
+			t.Errorf("Expected %s kept", domain)
+		}
+	}
+}
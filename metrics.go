@@ -0,0 +1,38 @@
+package ainaa
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// queryCount counts the queries per client identification source, profile
+// and action. Client IDs themselves are left out to bound the cardinality;
+// they are available through the metadata plugin.
+var queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: name,
+	Name:      "queries_total",
+	Help:      "Counter of queries per client identification source, profile and action.",
+}, []string{"server", "client_source", "profile", "action"})
+
+// upstreamDuration tracks the response time of every upstream server, be it a
+// resolver or a classifier.
+var upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: name,
+	Name:      "upstream_duration_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time each upstream server took to answer.",
+}, []string{"upstream"})
+
+func countQuery(ctx context.Context, client Client, profile *Profile, action string) {
+	var profileName string
+	if profile != nil {
+		profileName = profile.Name
+	}
+	queryCount.WithLabelValues(metrics.WithServer(ctx), client.Source, profileName, action).Inc()
+}
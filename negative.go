@@ -0,0 +1,121 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	// defaultNegativeTTL is the longest NXDOMAIN and NODATA answers are
+	// cached, whatever their SOA says.
+	defaultNegativeTTL = 5 * time.Minute
+	// defaultServfailTTL is how long failed lookups are cached.
+	defaultServfailTTL = 5 * time.Second
+)
+
+// Negative states of a cached domain, the upstream having no addresses for it.
+const (
+	// negativeNXDomain is a domain that does not exist.
+	negativeNXDomain = "nxdomain"
+	// negativeNoData is a domain that exists without A or AAAA records.
+	negativeNoData = "nodata"
+	// negativeServfail is a domain the upstream failed to look up.
+	negativeServfail = "servfail"
+)
+
+// errRecentFailure is returned for domains whose lookup failed moments ago,
+// instead of asking the upstream again.
+var errRecentFailure = errors.New("upstream lookup failed recently")
+
+// notFoundError is the error of a lookup for a domain that does not exist,
+// along with how long the upstream says that answer may be cached.
+type notFoundError struct {
+	*net.DNSError
+	// TTL is the negative caching TTL of the answer, zero if unknown.
+	TTL uint32
+}
+
+func (e *notFoundError) Unwrap() error { return e.DNSError }
+
+// errNotFound returns the error of a lookup of domain through server answered
+// NXDOMAIN, cacheable for ttl.
+func errNotFound(domain, server string, ttl uint32) error {
+	return &notFoundError{
+		DNSError: &net.DNSError{Err: "no such host", Name: domain, Server: server, IsNotFound: true},
+		TTL:      ttl,
+	}
+}
+
+// notFoundTTL returns the negative caching TTL of err, answerTTL if unknown.
+func notFoundTTL(err error) uint32 {
+	var nfErr *notFoundError
+	if errors.As(err, &nfErr) && nfErr.TTL > 0 {
+		return nfErr.TTL
+	}
+	return answerTTL
+}
+
+// negativeTTL returns how long a negative answer with the given TTL is
+// cached, answerTTL if unknown and at most NegativeTTL.
+func (a Ainaa) negativeTTL(ttl uint32) time.Duration {
+	if ttl == 0 {
+		ttl = answerTTL
+	}
+	return min(time.Duration(ttl)*time.Second, a.NegativeTTL)
+}
+
+// storeFailure caches that domain could not be classified because of err: it
+// does not exist, or the upstream failed. Nothing is stored in DynamoDB, the
+// domain is classified again once the entry expires.
+func (a Ainaa) storeFailure(ctx context.Context, domain string, err error) {
+	// A query that gave up says nothing about the domain.
+	if ctx.Err() != nil {
+		return
+	}
+	state, ttl := negativeServfail, a.ServfailTTL
+	if notFound(err) {
+		state, ttl = negativeNXDomain, a.negativeTTL(notFoundTTL(err))
+	}
+	if ttl <= 0 {
+		return
+	}
+	log.Debugf("Caching %s of domain %s for %s", state, domain, ttl)
+	expires := a.clock().Add(ttl).Unix()
+	rec := CachedDomain{NoInherit: true, Source: sourceResolver, Negative: state, Expires: expires, IPsExpire: expires}
+	a.Cache.Set(ctx, domain, rec, ttl)
+}
+
+// failed reports whether rec caches a domain that could not be classified:
+// it does not exist, or its lookup failed. Such a record holds no decision.
+func (rec CachedDomain) failed() bool {
+	return rec.Negative == negativeNXDomain || rec.Negative == negativeServfail
+}
+
+// failureExpired reports whether rec caches a failure that expired. It must
+// be looked up again rather than read as a domain nobody blocks, whatever
+// the cache still holds.
+func (a Ainaa) failureExpired(rec CachedDomain) bool {
+	return rec.failed() && !a.clock().Before(time.Unix(rec.Expires, 0))
+}
+
+// failed reports whether v caches a domain that could not be classified.
+func (v verdict) failed() bool {
+	return v.negative == negativeNXDomain || v.negative == negativeServfail
+}
+
+// failure returns the error cached by v for its domain: it does not exist,
+// or its lookup failed.
+func (v verdict) failure(t time.Time) error {
+	switch v.negative {
+	case negativeServfail:
+		return errRecentFailure
+	case negativeNXDomain:
+		ttl := uint32(max(v.expires.Sub(t)/time.Second, 1))
+		return errNotFound(v.zone, "", ttl)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestAinaa_ServeDNSNegative(t *testing.T) {
+	var queries atomic.Int32
+	s := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		queries.Add(1)
+		switch q.Name {
+		case "gone.example.com.":
+			return dns.RcodeNameError, nil, []dns.RR{test.SOA("example.com. 3600 IN SOA ns. host. 1 2 3 4 120")}
+		case "long.example.com.":
+			return dns.RcodeNameError, nil, []dns.RR{test.SOA("example.com. 3600 IN SOA ns. host. 1 2 3 4 3600")}
+		case "empty.example.com.":
+			return dns.RcodeSuccess, nil, []dns.RR{test.SOA("example.com. 3600 IN SOA ns. host. 1 2 3 4 120")}
+		}
+		return dns.RcodeServerFailure, nil, nil
+	})
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		qname       string
+		negativeTTL time.Duration
+		servfailTTL time.Duration
+		// expectedRcode is the answer to every query, expectedTTL the TTL of
+		// the SOA of the cached one.
+		expectedRcode int
+		expectedTTL   uint32
+		// expectedNegative and expectedCacheTTL are what is cached, nothing
+		// if expectedNegative is empty.
+		expectedNegative string
+		expectedCacheTTL time.Duration
+	}{
+		{
+			name:             "NXDOMAIN",
+			qname:            "gone.example.com.",
+			negativeTTL:      defaultNegativeTTL,
+			expectedRcode:    dns.RcodeNameError,
+			expectedTTL:      120,
+			expectedNegative: negativeNXDomain,
+			expectedCacheTTL: 120 * time.Second,
+		},
+		{
+			name:             "NXDOMAIN Capped",
+			qname:            "long.example.com.",
+			negativeTTL:      defaultNegativeTTL,
+			expectedRcode:    dns.RcodeNameError,
+			expectedTTL:      300,
+			expectedNegative: negativeNXDomain,
+			expectedCacheTTL: defaultNegativeTTL,
+		},
+		{
+			name:             "NODATA",
+			qname:            "empty.example.com.",
+			negativeTTL:      defaultNegativeTTL,
+			expectedRcode:    dns.RcodeSuccess,
+			expectedTTL:      120,
+			expectedNegative: negativeNoData,
+			expectedCacheTTL: time.Hour,
+		},
+		{
+			name:             "SERVFAIL",
+			qname:            "broken.example.com.",
+			servfailTTL:      defaultServfailTTL,
+			expectedRcode:    dns.RcodeServerFailure,
+			expectedNegative: negativeServfail,
+			expectedCacheTTL: defaultServfailTTL,
+		},
+		{
+			name:          "Disabled",
+			qname:         "gone.example.com.",
+			expectedRcode: dns.RcodeNameError,
+			expectedTTL:   120,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			cache := map[string]CachedDomain{}
+			var cacheTTL time.Duration
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						mu.Lock()
+						defer mu.Unlock()
+						if value, ok := cache[domain]; ok {
+							return value, nil
+						}
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+						mu.Lock()
+						defer mu.Unlock()
+						cache[domain], cacheTTL = value, ttl
+						return nil
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+				},
+				Resolver:    &OpenDNSResolver{Upstreams: NewUpstreams([]string{s.Addr}, UpstreamOptions{})},
+				CacheTTL:    time.Hour,
+				NegativeTTL: tt.negativeTTL,
+				ServfailTTL: tt.servfailTTL,
+				now:         func() time.Time { return now },
+			}
+
+			var asked int32
+			for i := range 2 {
+				r := new(dns.Msg)
+				r.SetQuestion(tt.qname, dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				a.ServeDNS(context.TODO(), rec, r)
+				if rec.Msg.Rcode != tt.expectedRcode {
+					t.Fatalf("Query %d: expected Rcode %d, got %d", i, tt.expectedRcode, rec.Msg.Rcode)
+				}
+				if len(rec.Msg.Answer) != 0 {
+					t.Errorf("Query %d: expected no answer, got %v", i, rec.Msg.Answer)
+				}
+				if i == 1 && tt.expectedTTL != 0 && (len(rec.Msg.Ns) != 1 || rec.Msg.Ns[0].Header().Ttl != tt.expectedTTL) {
+					t.Errorf("Query %d: expected an SOA with TTL %d, got %v", i, tt.expectedTTL, rec.Msg.Ns)
+				}
+				if i == 0 {
+					asked = queries.Load()
+				}
+			}
+
+			value, cached := cache[tt.qname[:len(tt.qname)-1]]
+			if tt.expectedNegative == "" {
+				if cached && !value.Absent {
+					t.Errorf("Expected nothing cached, got %+v", value)
+				}
+				if queries.Load() == asked {
+					t.Errorf("Expected the upstream asked again")
+				}
+				return
+			}
+			if !cached || value.Negative != tt.expectedNegative || cacheTTL != tt.expectedCacheTTL {
+				t.Errorf("Expected %s cached for %s, got %+v for %s", tt.expectedNegative, tt.expectedCacheTTL, value, cacheTTL)
+			}
+			if queries.Load() != asked {
+				t.Errorf("Expected the cached answer, got the upstream asked again")
+			}
+		})
+	}
+}
+
+func TestAinaa_ServeDNSExpiredFailure(t *testing.T) {
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		cached        CachedDomain
+		expectedRcode int
+		classified    bool
+	}{
+		{
+			name:          "Cached SERVFAIL",
+			cached:        CachedDomain{Source: sourceResolver, Negative: negativeServfail, Expires: now.Add(time.Second).Unix()},
+			expectedRcode: dns.RcodeServerFailure,
+		},
+		{
+			// The cache may keep the entry a little longer than it is valid,
+			// it must not be read as a domain nobody blocks.
+			name:          "Expired SERVFAIL",
+			cached:        CachedDomain{Source: sourceResolver, Negative: negativeServfail, Expires: now.Unix()},
+			expectedRcode: dns.RcodeNameError,
+			classified:    true,
+		},
+		{
+			name:          "Expired NXDOMAIN",
+			cached:        CachedDomain{Source: sourceResolver, Negative: negativeNXDomain, Expires: now.Add(-time.Second).Unix()},
+			expectedRcode: dns.RcodeNameError,
+			classified:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified := false
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						if domain == "tracker.example.com" {
+							return tt.cached, nil
+						}
+						return CachedDomain{}, errors.New("miss")
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						return DomainRecord{}, ErrDomainNotFound
+					},
+				},
+				Classifier: &MockClassifier{ClassifyFunc: func(ctx context.Context, domain string) (Classification, error) {
+					classified = true
+					return Classification{Blocked: true}, nil
+				}},
+				BlockStatus: defaultBlockStatus,
+				CacheTTL:    time.Hour,
+				ServfailTTL: defaultServfailTTL,
+				now:         func() time.Time { return now },
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion("tracker.example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			a.ServeDNS(context.TODO(), rec, r)
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			if classified != tt.classified {
+				t.Errorf("Expected classified %t, got %t", tt.classified, classified)
+			}
+		})
+	}
+}
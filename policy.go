@@ -0,0 +1,147 @@
+package ainaa
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Action is what the plugin does with a query for a domain in a category.
+type Action int
+
+const (
+	// ActionBlock answers with the category's block response.
+	ActionBlock Action = iota
+	// ActionAllow answers as if the domain had no status.
+	ActionAllow
+	// ActionLog allows the domain but logs every query for it.
+	ActionLog
+	// ActionRedirect answers with the category's redirect target.
+	ActionRedirect
+)
+
+var actions = map[string]Action{
+	"block":    ActionBlock,
+	"allow":    ActionAllow,
+	"log":      ActionLog,
+	"redirect": ActionRedirect,
+}
+
+func (a Action) String() string {
+	for name, action := range actions {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Category describes the domains stored with a given status.
+type Category struct {
+	Name   string
+	Action Action
+	// Response overrides the instance's block response for ActionBlock and
+	// holds the redirect addresses for ActionRedirect.
+	Response *BlockResponse
+	// Target is the name ActionRedirect answers with a CNAME to, when the
+	// redirect is not to addresses.
+	Target string
+}
+
+// category returns the category for status. Status 0 is always allowed and
+// unknown statuses are blocked with the default response.
+func (a Ainaa) category(status int) Category {
+	if status == 0 {
+		return Category{Action: ActionAllow}
+	}
+	if cat, ok := a.Categories[status]; ok {
+		return cat
+	}
+	return Category{Action: ActionBlock}
+}
+
+// categoryFor returns the category of the verdict, with its action overridden
+// by the client's profile as scheduled at t.
+func (a Ainaa) categoryFor(v verdict, profile *Profile, t time.Time) Category {
+	if v.denied {
+		return Category{Action: ActionBlock}
+	}
+	cat := a.category(v.status)
+	if profile == nil || v.status == 0 {
+		return cat
+	}
+	if action, ok := profile.action(v.status, t); ok && action != cat.Action {
+		if cat.Action == ActionRedirect {
+			// The redirect target is no block response.
+			cat.Response, cat.Target = nil, ""
+		}
+		cat.Action = action
+	}
+	return cat
+}
+
+// describe returns a readable description of the verdict's status, such as
+// "malware (status 1)".
+func (a Ainaa) describe(v verdict) string {
+	if v.denied {
+		return "denied"
+	}
+	if cat := a.category(v.status); cat.Name != "" {
+		return fmt.Sprintf("%s (status %d)", cat.Name, v.status)
+	}
+	return "status " + strconv.Itoa(v.status)
+}
+
+// parseCategory parses "NAME ACTION [ARGS...]", where ARGS is an optional
+// block response for block and the target addresses or name for redirect.
+func parseCategory(args []string) (Category, error) {
+	if len(args) < 2 {
+		return Category{}, fmt.Errorf("category needs a name and an action")
+	}
+	cat := Category{Name: args[0]}
+	action, ok := actions[args[1]]
+	if !ok {
+		return Category{}, fmt.Errorf("unknown action %q for category %s", args[1], cat.Name)
+	}
+	cat.Action = action
+	args = args[2:]
+
+	switch action {
+	case ActionBlock:
+		if len(args) > 0 {
+			br, err := parseBlockResponse(args)
+			if err != nil {
+				return Category{}, err
+			}
+			cat.Response = &br
+		}
+	case ActionRedirect:
+		if len(args) == 0 {
+			return Category{}, fmt.Errorf("redirect for category %s needs a target", cat.Name)
+		}
+		if net.ParseIP(args[0]) != nil {
+			br, err := parseBlockResponse(append([]string{"sinkhole"}, args...))
+			if err != nil {
+				return Category{}, err
+			}
+			cat.Response = &br
+			break
+		}
+		if len(args) > 1 {
+			return Category{}, fmt.Errorf("redirect for category %s takes a single name", cat.Name)
+		}
+		target, err := normalizeDomain(args[0])
+		if err != nil {
+			return Category{}, err
+		}
+		cat.Target = dns.Fqdn(target)
+	default:
+		if len(args) > 0 {
+			return Category{}, fmt.Errorf("action %s takes no arguments", action)
+		}
+	}
+	return cat, nil
+}
@@ -0,0 +1,81 @@
+package ainaa
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	// defaultPrefetchWindow is the period hits are counted over.
+	defaultPrefetchWindow = 1 * time.Minute
+	// defaultPrefetchPercentage is the part of CacheTTL left when popular
+	// entries are refreshed.
+	defaultPrefetchPercentage = 10
+)
+
+// Prefetch refreshes the cache entries of popular domains before they
+// expire, so the domains most asked for never pay for a miss.
+type Prefetch struct {
+	// Amount is how many hits an entry needs within Window to be refreshed;
+	// zero disables prefetching.
+	Amount int
+	Window time.Duration
+	// Percentage is the part of CacheTTL left when entries are refreshed.
+	Percentage int
+}
+
+// hitCounter counts the hits of every domain over fixed windows.
+type hitCounter struct {
+	mu     sync.Mutex
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newHitCounter(window time.Duration) *hitCounter {
+	return &hitCounter{window: window, counts: make(map[string]int)}
+}
+
+// hit counts a hit of domain at now and returns its hits in the current
+// window.
+func (h *hitCounter) hit(domain string, now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.start) >= h.window {
+		h.start = now
+		clear(h.counts)
+	}
+	h.counts[domain]++
+	return h.counts[domain]
+}
+
+// popular counts a hit of the entry cached for the queried domain zone and
+// reports whether it is asked for often enough and close enough to expiry to
+// be refreshed.
+func (a Ainaa) popular(zone string, rec CachedDomain) bool {
+	if a.hits == nil || a.Prefetch.Amount <= 0 {
+		return false
+	}
+	now := a.clock()
+	if a.hits.hit(zone, now) < a.Prefetch.Amount || rec.Expires == 0 {
+		return false
+	}
+	left := time.Unix(rec.Expires, 0).Sub(now)
+	return left <= a.CacheTTL*time.Duration(a.Prefetch.Percentage)/100
+}
+
+// prefetch refreshes the entry cached for zone from DynamoDB and, if it
+// holds addresses, looks them up again.
+func (a Ainaa) prefetch(ctx context.Context, zone string, rec CachedDomain) error {
+	log.Debugf("Prefetching popular domain %s", zone)
+	if err := a.refreshZone(ctx, zone, rec); err != nil {
+		return err
+	}
+	if rec.IPs == nil {
+		return nil
+	}
+	return a.refreshAddresses(ctx, zone)
+}
@@ -0,0 +1,139 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestHitCounter(t *testing.T) {
+	start := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+	h := newHitCounter(time.Minute)
+
+	for i, tt := range []struct {
+		domain   string
+		at       time.Duration
+		expected int
+	}{
+		{"example.com", 0, 1},
+		{"example.com", 10 * time.Second, 2},
+		{"example.org", 20 * time.Second, 1},
+		{"example.com", 59 * time.Second, 3},
+		{"example.com", time.Minute, 1},
+		{"example.org", 90 * time.Second, 1},
+	} {
+		if got := h.hit(tt.domain, start.Add(tt.at)); got != tt.expected {
+			t.Errorf("Hit %d: expected %d hits of %s, got %d", i, tt.expected, tt.domain, got)
+		}
+	}
+}
+
+func TestAinaa_ServeDNSPrefetch(t *testing.T) {
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		qname   string
+		cached  CachedDomain
+		queries int
+		// expectedPrefetch is what the prefetch caches, nil if it caches nothing.
+		expectedPrefetch *CachedDomain
+	}{
+		{
+			name:    "Unpopular",
+			cached:  CachedDomain{Status: 1, Expires: now.Add(time.Minute).Unix()},
+			queries: 1,
+		},
+		{
+			name:    "Popular Far From Expiry",
+			cached:  CachedDomain{Status: 1, Expires: now.Add(30 * time.Minute).Unix()},
+			queries: 3,
+		},
+		{
+			name:             "Popular Near Expiry",
+			cached:           CachedDomain{Status: 1, Expires: now.Add(time.Minute).Unix()},
+			queries:          2,
+			expectedPrefetch: &CachedDomain{Status: 0, Expires: now.Add(time.Hour).Unix()},
+		},
+		{
+			// Subdomains inheriting the record don't make it popular.
+			name:    "Popular Subdomain",
+			qname:   "www.example.com.",
+			cached:  CachedDomain{Status: 1, Expires: now.Add(time.Minute).Unix()},
+			queries: 3,
+		},
+		{
+			name:    "Popular Without Expiry",
+			cached:  CachedDomain{Status: 1},
+			queries: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefetched := make(chan CachedDomain, 1)
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						if domain == "example.com" {
+							return tt.cached, nil
+						}
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+						if !value.Absent {
+							prefetched <- value
+						}
+						return nil
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						if domain != "example.com" {
+							return DomainRecord{}, ErrDomainNotFound
+						}
+						return DomainRecord{Domain: domain}, nil
+					},
+				},
+				CacheTTL: time.Hour,
+				Prefetch: Prefetch{Amount: 2, Window: time.Minute, Percentage: 10},
+				hits:     newHitCounter(time.Minute),
+				now:      func() time.Time { return now },
+			}
+
+			qname := tt.qname
+			if qname == "" {
+				qname = "example.com."
+			}
+			for range tt.queries {
+				r := new(dns.Msg)
+				r.SetQuestion(qname, dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+					t.Fatalf("Expected no errors, but got: %v", err)
+				}
+				if rec.Msg.Rcode != dns.RcodeNameError {
+					t.Fatalf("Expected the cached decision, got Rcode %d", rec.Msg.Rcode)
+				}
+			}
+
+			select {
+			case value := <-prefetched:
+				if tt.expectedPrefetch == nil {
+					t.Errorf("Expected nothing cached, got %+v", value)
+				} else if !reflect.DeepEqual(value, *tt.expectedPrefetch) {
+					t.Errorf("Expected %+v prefetched, got %+v", *tt.expectedPrefetch, value)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.expectedPrefetch != nil {
+					t.Errorf("Expected %+v prefetched, got nothing", *tt.expectedPrefetch)
+				}
+			}
+		})
+	}
+}
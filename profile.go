@@ -0,0 +1,366 @@
+package ainaa
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Profile is a set of filtering rules applied to a group of clients.
+type Profile struct {
+	Name     string
+	Networks []netip.Prefix
+	// Clients lists the IDs of the devices of the profile, whatever their
+	// address.
+	Clients []string
+	// Actions overrides the action of the categories of the listed statuses.
+	Actions map[int]Action
+	// Allowlist and Denylist hold domains always allowed or always blocked
+	// for clients of the profile, along with their subdomains.
+	Allowlist DomainList
+	Denylist  DomainList
+	// BlockResponse, if set, is used for every blocked answer.
+	BlockResponse *BlockResponse
+	// Schedule, if set, limits the profile to the times it is active; the
+	// rest of the time its clients are matched as if it did not exist.
+	Schedule *Schedule
+	// Scheduled overrides category actions while their schedule is active,
+	// taking precedence over Actions.
+	Scheduled []ScheduledActions
+}
+
+// ScheduledActions overrides the action of categories while Schedule is active.
+type ScheduledActions struct {
+	Schedule *Schedule
+	Actions  map[int]Action
+}
+
+// newProfile builds a profile from rec, resolving category names with
+// categories and schedule names with schedules.
+func newProfile(rec ProfileRecord, categories map[int]Category, schedules map[string]*Schedule) (*Profile, error) {
+	if rec.Name == "" {
+		return nil, fmt.Errorf("profile without a name")
+	}
+	p := &Profile{
+		Name:      rec.Name,
+		Actions:   make(map[int]Action),
+		Allowlist: DomainList{},
+		Denylist:  DomainList{},
+	}
+
+	for _, network := range rec.Networks {
+		prefix, err := parsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+		}
+		p.Networks = append(p.Networks, prefix)
+	}
+	p.Clients = rec.Clients
+
+	for action, names := range map[Action][]string{
+		ActionBlock: rec.BlockCategories,
+		ActionAllow: rec.AllowCategories,
+		ActionLog:   rec.LogCategories,
+	} {
+		for _, name := range names {
+			status, err := resolveCategory(categories, name)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+			}
+			if other, ok := p.Actions[status]; ok && other != action {
+				return nil, fmt.Errorf("profile %s: category %s is both %s and %s", rec.Name, name, other, action)
+			}
+			p.Actions[status] = action
+		}
+	}
+
+	for _, domain := range rec.Allow {
+		if err := p.Allowlist.Add(domain); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+		}
+	}
+	for _, domain := range rec.Deny {
+		if err := p.Denylist.Add(domain); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+		}
+	}
+
+	if rec.BlockResponse != "" {
+		br, err := parseBlockResponse(strings.Fields(rec.BlockResponse))
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+		}
+		p.BlockResponse = &br
+	}
+
+	if rec.Schedule != "" {
+		schedule, ok := schedules[rec.Schedule]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown schedule %q", rec.Name, rec.Schedule)
+		}
+		p.Schedule = schedule
+	}
+	for _, rule := range rec.Scheduled {
+		sa, err := parseScheduledActions(strings.Fields(rule), categories, schedules)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", rec.Name, err)
+		}
+		p.Scheduled = append(p.Scheduled, sa)
+	}
+	return p, nil
+}
+
+// parseScheduledActions parses "SCHEDULE ACTION CATEGORY...", where ACTION is
+// block, allow or log.
+func parseScheduledActions(args []string, categories map[int]Category, schedules map[string]*Schedule) (ScheduledActions, error) {
+	if len(args) < 3 {
+		return ScheduledActions{}, fmt.Errorf("scheduled rule needs a schedule, an action and categories")
+	}
+	schedule, ok := schedules[args[0]]
+	if !ok {
+		return ScheduledActions{}, fmt.Errorf("unknown schedule %q", args[0])
+	}
+	action, ok := actions[args[1]]
+	if !ok || action == ActionRedirect {
+		return ScheduledActions{}, fmt.Errorf("invalid scheduled action %q, expected block, allow or log", args[1])
+	}
+	sa := ScheduledActions{Schedule: schedule, Actions: make(map[int]Action)}
+	for _, name := range args[2:] {
+		status, err := resolveCategory(categories, name)
+		if err != nil {
+			return ScheduledActions{}, err
+		}
+		sa.Actions[status] = action
+	}
+	return sa, nil
+}
+
+// active reports whether the profile applies at t.
+func (p *Profile) active(t time.Time) bool {
+	return p.Schedule == nil || p.Schedule.Active(t)
+}
+
+// action returns the action the profile sets at t for the category of
+// status, if it overrides it. The first active scheduled rule wins.
+func (p *Profile) action(status int, t time.Time) (Action, bool) {
+	for _, sa := range p.Scheduled {
+		if action, ok := sa.Actions[status]; ok && sa.Schedule.Active(t) {
+			return action, true
+		}
+	}
+	action, ok := p.Actions[status]
+	return action, ok
+}
+
+// matchLists checks domain against the allow and deny lists of the profile.
+// The most specific listed name wins, deny winning ties.
+func (p *Profile) matchLists(domain string) (zone string, denied, ok bool) {
+	if p == nil {
+		return "", false, false
+	}
+	for _, zone := range domainAndParents(domain) {
+		if _, ok := p.Denylist[zone]; ok {
+			return zone, true, true
+		}
+		if _, ok := p.Allowlist[zone]; ok {
+			return zone, false, true
+		}
+	}
+	return "", false, false
+}
+
+// resolveCategory returns the status of the category called name, which may
+// also be given as a status number.
+func resolveCategory(categories map[int]Category, name string) (int, error) {
+	if status, err := strconv.Atoi(name); err == nil && status > 0 {
+		return status, nil
+	}
+	if status, ok := categoryStatus(categories, name); ok {
+		return status, nil
+	}
+	return 0, fmt.Errorf("unknown category %q", name)
+}
+
+// parsePrefix parses a CIDR prefix or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+type profileEntry struct {
+	prefix  netip.Prefix
+	profile *Profile
+}
+
+type profileIndex struct {
+	clients map[string]*Profile
+	// entries are sorted from the most to the least specific network.
+	entries []profileEntry
+}
+
+// Profiles selects the profile of a client by its ID, or else by its address;
+// the most specific network wins. Profiles from the Corefile are fixed, those
+// from the repository are replaced on every Reload.
+type Profiles struct {
+	static     []*Profile
+	categories map[int]Category
+	schedules  map[string]*Schedule
+	repo       ProfileRepository
+
+	index atomic.Pointer[profileIndex]
+}
+
+// NewProfiles returns the profiles selecting among static and, if repo is not
+// nil, the profiles loaded from it, which may refer to schedules.
+func NewProfiles(static []*Profile, categories map[int]Category, schedules map[string]*Schedule, repo ProfileRepository) (*Profiles, error) {
+	p := &Profiles{static: static, categories: categories, schedules: schedules, repo: repo}
+	if err := p.set(static); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Match returns the profile of client active at t, or nil if there is none.
+func (p *Profiles) Match(client Client, t time.Time) *Profile {
+	if p == nil {
+		return nil
+	}
+	index := p.index.Load()
+	if profile, ok := index.clients[client.ID]; ok && client.ID != "" && profile.active(t) {
+		return profile
+	}
+	addr := client.Addr.Unmap()
+	for _, e := range index.entries {
+		if e.prefix.Contains(addr) && e.profile.active(t) {
+			return e.profile
+		}
+	}
+	return nil
+}
+
+// Reload replaces the profiles loaded from the repository.
+func (p *Profiles) Reload(ctx context.Context) error {
+	if p.repo == nil {
+		return nil
+	}
+	records, err := p.repo.LoadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	profiles := append([]*Profile(nil), p.static...)
+	names := make(map[string]bool)
+	bound := newBindings()
+	for _, profile := range p.static {
+		names[profile.Name] = true
+		bound.bind(profile)
+	}
+	for _, rec := range records {
+		if names[rec.Name] {
+			log.Warningf("Ignoring stored profile %s, it is defined in the Corefile", rec.Name)
+			continue
+		}
+		profile, err := newProfile(rec, p.categories, p.schedules)
+		if err != nil {
+			log.Warningf("Ignoring stored profile: %v", err)
+			continue
+		}
+		if err := bound.bind(profile); err != nil {
+			log.Warningf("Ignoring stored profile %s: %v", rec.Name, err)
+			continue
+		}
+		names[rec.Name] = true
+		profiles = append(profiles, profile)
+	}
+	return p.set(profiles)
+}
+
+// refresh reloads the profiles every interval until stop is closed.
+func (p *Profiles) refresh(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := p.Reload(ctx); err != nil {
+				log.Warningf("Failed to reload profiles: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// bindings are the networks and client IDs bound to profiles, by the name of
+// their profile.
+type bindings struct {
+	networks map[netip.Prefix]string
+	clients  map[string]string
+}
+
+func newBindings() bindings {
+	return bindings{networks: make(map[netip.Prefix]string), clients: make(map[string]string)}
+}
+
+// bind binds the networks and client IDs of profile to it, unless one of them
+// is already bound to another profile, in which case nothing is bound.
+func (b bindings) bind(profile *Profile) error {
+	for _, prefix := range profile.Networks {
+		if other, ok := b.networks[prefix]; ok {
+			return fmt.Errorf("network %s is bound to profiles %s and %s", prefix, other, profile.Name)
+		}
+	}
+	for _, id := range profile.Clients {
+		if other, ok := b.clients[id]; ok {
+			return fmt.Errorf("client %s is bound to profiles %s and %s", id, other, profile.Name)
+		}
+	}
+	for _, prefix := range profile.Networks {
+		b.networks[prefix] = profile.Name
+	}
+	for _, id := range profile.Clients {
+		b.clients[id] = profile.Name
+	}
+	return nil
+}
+
+func (p *Profiles) set(profiles []*Profile) error {
+	index := &profileIndex{clients: make(map[string]*Profile)}
+	bound := newBindings()
+	for _, profile := range profiles {
+		if err := bound.bind(profile); err != nil {
+			return err
+		}
+		for _, prefix := range profile.Networks {
+			index.entries = append(index.entries, profileEntry{prefix: prefix, profile: profile})
+		}
+		for _, id := range profile.Clients {
+			index.clients[id] = profile
+		}
+	}
+	sort.SliceStable(index.entries, func(i, j int) bool {
+		return index.entries[i].prefix.Bits() > index.entries[j].prefix.Bits()
+	})
+	p.index.Store(index)
+	return nil
+}
@@ -0,0 +1,75 @@
+package ainaa
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type MockProfileRepository struct {
+	LoadProfilesFunc func(ctx context.Context) ([]ProfileRecord, error)
+}
+
+func (m *MockProfileRepository) LoadProfiles(ctx context.Context) ([]ProfileRecord, error) {
+	return m.LoadProfilesFunc(ctx)
+}
+
+func TestProfiles_Reload(t *testing.T) {
+	static, err := newProfile(ProfileRecord{Name: "office", Networks: []string{"10.0.0.0/8"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := []ProfileRecord{
+		{Name: "kids", Networks: []string{"10.1.0.0/16"}, Clients: []string{"tablet", "02:00:5e:00:53:01"}},
+		{Name: "office", Networks: []string{"192.0.2.0/24"}},
+		{Name: "broken", Networks: []string{"not-a-network"}},
+		{Name: "guest", Networks: []string{"10.1.2.3", "::ffff:192.0.2.200"}},
+		// Profiles conflicting with others are skipped, the rest still load.
+		{Name: "intruder", Networks: []string{"10.1.0.0/16"}},
+		{Name: "copycat", Networks: []string{"198.51.100.0/24"}, Clients: []string{"tablet"}},
+	}
+	profiles, err := NewProfiles([]*Profile{static}, nil, nil, &MockProfileRepository{
+		LoadProfilesFunc: func(ctx context.Context) ([]ProfileRecord, error) {
+			return stored, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := profiles.Match(Client{Addr: netip.MustParseAddr("10.1.2.3")}, time.Now()); p == nil || p.Name != "office" {
+		t.Fatalf("Expected only the static profile before Reload, got %v", p)
+	}
+	if err := profiles.Reload(context.TODO()); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	tests := []struct {
+		addr     string
+		id       string
+		expected string
+	}{
+		{addr: "10.9.9.9", expected: "office"},
+		{addr: "10.1.9.9", expected: "kids"},
+		{addr: "10.1.2.3", expected: "guest"},
+		{addr: "::ffff:10.1.2.3", expected: "guest"},
+		{addr: "192.0.2.200", expected: "guest"},
+		{addr: "192.0.2.1", expected: ""},
+		{addr: "2001:db8::1", expected: ""},
+		{addr: "198.51.100.1", expected: ""},
+		{addr: "192.0.2.1", id: "tablet", expected: "kids"},
+		{addr: "10.1.2.3", id: "02:00:5e:00:53:01", expected: "kids"},
+		{addr: "10.9.9.9", id: "laptop", expected: "office"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+" "+tt.id, func(t *testing.T) {
+			var got string
+			if p := profiles.Match(Client{Addr: netip.MustParseAddr(tt.addr), ID: tt.id}, time.Now()); p != nil {
+				got = p.Name
+			}
+			if got != tt.expected {
+				t.Errorf("Expected profile %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
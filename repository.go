@@ -2,9 +2,14 @@ package ainaa
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+// ErrDomainNotFound is returned by PersistentRepository.Get for domains that
+// have no record.
+var ErrDomainNotFound = errors.New("domain not found")
+
 // CacheRepository defines the interface for caching operations.
 type CacheRepository interface {
 	Get(ctx context.Context, domain string) (CachedDomain, error)
@@ -12,7 +17,14 @@ type CacheRepository interface {
 }
 
 // PersistentRepository defines the interface for persistent storage operations.
+// Save stores a new record and never replaces an existing one, which may
+// have been added by an administrator since the domain was looked up.
 type PersistentRepository interface {
 	Get(ctx context.Context, domain string) (DomainRecord, error)
 	Save(ctx context.Context, record DomainRecord) error
 }
+
+// ProfileRepository defines the interface for loading client profiles.
+type ProfileRepository interface {
+	LoadProfiles(ctx context.Context) ([]ProfileRecord, error)
+}
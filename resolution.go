@@ -0,0 +1,213 @@
+package ainaa
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEs bounds the CNAME chains followed in an answer.
+const maxCNAMEs = 16
+
+// Resolution is an upstream's answer for the addresses of a domain, as it
+// was received: records keep their TTLs and negative answers their SOA.
+type Resolution struct {
+	// Rcode is dns.RcodeSuccess, or dns.RcodeNameError when the domain does
+	// not exist.
+	Rcode int
+	// CNAMEs is the chain of aliases from the domain to its canonical name.
+	CNAMEs []*dns.CNAME
+	// Records are the A and AAAA records of the canonical name.
+	Records []dns.RR
+	// SOA is the authority of a negative answer, NXDOMAIN or NODATA, if the
+	// upstream gave one.
+	SOA *dns.SOA
+}
+
+// IPs returns the addresses of the resolution keyed by record type.
+func (r Resolution) IPs() map[string][]string {
+	ips := make(map[string][]string)
+	for _, rr := range r.Records {
+		if addr, ok := rrAddr(rr); ok {
+			t := dns.TypeToString[rr.Header().Rrtype]
+			ips[t] = append(ips[t], addr.String())
+		}
+	}
+	return ips
+}
+
+// TTL returns how long the resolution stays valid: the lowest TTL of its
+// aliases and records or, for negative answers, the negative caching TTL of
+// RFC 2308, the lower of the SOA's TTL and MINIMUM. Zero if unknown.
+func (r Resolution) TTL() uint32 {
+	var rrs []dns.RR
+	for _, c := range r.CNAMEs {
+		rrs = append(rrs, c)
+	}
+	if len(r.Records) > 0 {
+		return minTTL(append(rrs, r.Records...))
+	}
+	if r.SOA == nil {
+		return 0
+	}
+	return minTTL(append(rrs, r.SOA), r.SOA.Minttl)
+}
+
+// chain returns the names the aliases of the resolution lead to, in order.
+func (r Resolution) chain() []string {
+	var names []string
+	for _, c := range r.CNAMEs {
+		names = append(names, strings.ToLower(strings.TrimSuffix(c.Target, ".")))
+	}
+	return names
+}
+
+// has reports whether the resolution holds records of type qtype.
+func (r Resolution) has(qtype uint16) bool {
+	for _, rr := range r.Records {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// answer returns the answer section for a qtype query for owner: the aliases
+// leading from owner to its canonical name, then the canonical name's records.
+func (r Resolution) answer(owner string, qtype uint16) []dns.RR {
+	var answer []dns.RR
+	for _, c := range r.CNAMEs {
+		answer = append(answer, dns.Copy(c))
+	}
+	for _, rr := range r.Records {
+		if rr.Header().Rrtype == qtype {
+			answer = append(answer, dns.Copy(rr))
+		}
+	}
+	// The question may spell the name differently.
+	if len(answer) > 0 {
+		answer[0].Header().Name = owner
+	}
+	return answer
+}
+
+// negative returns the authority section of a negative answer for owner: the
+// upstream's SOA with its negative caching TTL, or else the plugin's own.
+func (r Resolution) negative(owner string) []dns.RR {
+	if r.SOA == nil {
+		return []dns.RR{soa(owner)}
+	}
+	rr := dns.Copy(r.SOA).(*dns.SOA)
+	rr.Hdr.Ttl = r.TTL()
+	return []dns.RR{rr}
+}
+
+// resolutionOf returns the resolution of domain aliased through cnames to a
+// name holding ips, every record living for ttl. It rebuilds resolutions from
+// the addresses known to the cache or given by resolvers that only give
+// addresses.
+func resolutionOf(domain string, cnames []string, ips map[string][]string, ttl uint32) Resolution {
+	var res Resolution
+	owner := dns.Fqdn(domain)
+	for _, target := range cnames {
+		res.CNAMEs = append(res.CNAMEs, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: dns.Fqdn(target),
+		})
+		owner = dns.Fqdn(target)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range addressRecords(owner, qtype, ips) {
+			rr.Header().Ttl = ttl
+			res.Records = append(res.Records, rr)
+		}
+	}
+	if len(res.Records) == 0 {
+		// NODATA, cacheable as long as the records would have been.
+		rr := soa(dns.Fqdn(domain)).(*dns.SOA)
+		rr.Hdr.Ttl, rr.Minttl = ttl, ttl
+		res.SOA = rr
+	}
+	return res
+}
+
+// resolve looks up the A and AAAA records of domain through s. A domain that
+// does not exist is an answer, not an error.
+func resolve(ctx context.Context, s *upstream, domain string) (Resolution, error) {
+	var res Resolution
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := s.query(ctx, domain, qtype)
+		if err != nil {
+			return Resolution{}, err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return Resolution{}, errRcode(domain, s.addr, resp.Rcode)
+		}
+		cnames, records := chase(resp, domain, qtype)
+		if res.CNAMEs == nil {
+			res.CNAMEs = cnames
+		}
+		res.Records = append(res.Records, records...)
+		if res.SOA == nil {
+			res.SOA = authority(resp)
+		}
+		if resp.Rcode == dns.RcodeNameError {
+			res.Rcode = dns.RcodeNameError
+			return res, nil
+		}
+	}
+	return res, nil
+}
+
+// chase follows the CNAME chain of resp from domain and returns it along
+// with the qtype records of the canonical name.
+func chase(resp *dns.Msg, domain string, qtype uint16) ([]*dns.CNAME, []dns.RR) {
+	var cnames []*dns.CNAME
+	owner := dns.Fqdn(domain)
+	for len(cnames) < maxCNAMEs {
+		var next *dns.CNAME
+		for _, rr := range resp.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, owner) {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		cnames = append(cnames, next)
+		owner = next.Target
+	}
+
+	var records []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, owner) {
+			records = append(records, rr)
+		}
+	}
+	return cnames, records
+}
+
+// authority returns the SOA record of the authority section of resp, if any.
+func authority(resp *dns.Msg) *dns.SOA {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// minTTL returns the lowest TTL of rrs and extra, zero if there are none.
+func minTTL(rrs []dns.RR, extra ...uint32) uint32 {
+	ttls := append([]uint32(nil), extra...)
+	for _, rr := range rrs {
+		ttls = append(ttls, rr.Header().Ttl)
+	}
+	if len(ttls) == 0 {
+		return 0
+	}
+	return slices.Min(ttls)
+}
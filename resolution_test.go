@@ -0,0 +1,60 @@
+package ainaa
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestResolution(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		test.CNAME("www.example.com. 600 IN CNAME edge.example.com."),
+		test.CNAME("edge.example.com. 60 IN CNAME cdn.example.net."),
+		test.A("cdn.example.net. 300 IN A 192.0.2.1"),
+		test.A("other.example.net. 10 IN A 192.0.2.2"),
+	}
+	cnames, records := chase(resp, "www.example.com", dns.TypeA)
+	res := Resolution{CNAMEs: cnames, Records: records}
+
+	if len(cnames) != 2 || cnames[1].Target != "cdn.example.net." {
+		t.Fatalf("Expected the chain to cdn.example.net., got %v", cnames)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected only the records of the canonical name, got %v", records)
+	}
+	if ttl := res.TTL(); ttl != 60 {
+		t.Errorf("Expected TTL 60, got %d", ttl)
+	}
+	if chain := res.chain(); len(chain) != 2 || chain[0] != "edge.example.com" || chain[1] != "cdn.example.net" {
+		t.Errorf("Expected the aliases edge.example.com and cdn.example.net, got %v", chain)
+	}
+	answer := res.answer("WWW.example.com.", dns.TypeA)
+	expected := []dns.RR{
+		test.CNAME("WWW.example.com. 600 IN CNAME edge.example.com."),
+		test.CNAME("edge.example.com. 60 IN CNAME cdn.example.net."),
+		test.A("cdn.example.net. 300 IN A 192.0.2.1"),
+	}
+	if fmt.Sprint(answer) != fmt.Sprint(expected) {
+		t.Errorf("Expected the answer %v, got %v", expected, answer)
+	}
+	if cnames[0].Hdr.Name != "www.example.com." {
+		t.Errorf("Expected the received records untouched, got %v", cnames[0])
+	}
+	if res.has(dns.TypeAAAA) {
+		t.Errorf("Expected no AAAA records")
+	}
+
+	negative := Resolution{Rcode: dns.RcodeNameError, SOA: test.SOA("example.com. 3600 IN SOA ns. host. 1 2 3 4 120")}
+	if ttl := negative.TTL(); ttl != 120 {
+		t.Errorf("Expected the negative TTL of the SOA minimum 120, got %d", ttl)
+	}
+	if ns := negative.negative("gone.example.com."); len(ns) != 1 || ns[0].Header().Ttl != 120 || ns[0].Header().Name != "example.com." {
+		t.Errorf("Expected the upstream's SOA with TTL 120, got %v", ns)
+	}
+	if ttl := (Resolution{}).TTL(); ttl != 0 {
+		t.Errorf("Expected no TTL for an empty resolution, got %d", ttl)
+	}
+}
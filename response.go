@@ -0,0 +1,206 @@
+package ainaa
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// BlockStyle selects how a query for a blocked domain is answered.
+type BlockStyle int
+
+const (
+	// BlockNXDomain answers NXDOMAIN with a synthesized SOA.
+	BlockNXDomain BlockStyle = iota
+	// BlockNoData answers NOERROR without records and a synthesized SOA.
+	BlockNoData
+	// BlockRefused answers REFUSED.
+	BlockRefused
+	// BlockNullIP answers A queries with 0.0.0.0 and AAAA queries with ::.
+	BlockNullIP
+	// BlockSinkhole answers A and AAAA queries with the configured addresses.
+	BlockSinkhole
+)
+
+var blockStyles = map[string]BlockStyle{
+	"nxdomain": BlockNXDomain,
+	"nodata":   BlockNoData,
+	"refused":  BlockRefused,
+	"null":     BlockNullIP,
+	"sinkhole": BlockSinkhole,
+}
+
+var nullIPs = map[string][]string{
+	"A":    {"0.0.0.0"},
+	"AAAA": {"::"},
+}
+
+// BlockResponse describes the answer given for blocked domains.
+type BlockResponse struct {
+	Style BlockStyle
+	// IPs are the sinkhole addresses keyed by record type, used with BlockSinkhole.
+	IPs map[string][]string
+}
+
+// parseBlockResponse parses "STYLE [ADDRESS...]", where addresses are only
+// accepted, and required, for the sinkhole style.
+func parseBlockResponse(args []string) (BlockResponse, error) {
+	if len(args) == 0 {
+		return BlockResponse{}, fmt.Errorf("missing block response style")
+	}
+	style, ok := blockStyles[args[0]]
+	if !ok {
+		return BlockResponse{}, fmt.Errorf("unknown block response style %q", args[0])
+	}
+	br := BlockResponse{Style: style}
+	addrs := args[1:]
+	if style != BlockSinkhole {
+		if len(addrs) > 0 {
+			return BlockResponse{}, fmt.Errorf("block response style %q takes no addresses", args[0])
+		}
+		return br, nil
+	}
+
+	if len(addrs) == 0 || len(addrs) > 2 {
+		return BlockResponse{}, fmt.Errorf("sinkhole needs an IPv4 and/or an IPv6 address")
+	}
+	br.IPs = make(map[string][]string)
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return BlockResponse{}, fmt.Errorf("invalid sinkhole address %q", addr)
+		}
+		qtype := "AAAA"
+		if ip.To4() != nil {
+			qtype = "A"
+		}
+		if len(br.IPs[qtype]) > 0 {
+			return BlockResponse{}, fmt.Errorf("more than one %s sinkhole address", qtype)
+		}
+		br.IPs[qtype] = []string{ip.String()}
+	}
+	return br, nil
+}
+
+var edeCodes = map[string]uint16{
+	"blocked":  dns.ExtendedErrorCodeBlocked,
+	"filtered": dns.ExtendedErrorCodeFiltered,
+	"censored": dns.ExtendedErrorCodeCensored,
+}
+
+// setEDE attaches an Extended DNS Error option to resp, provided the client
+// sent an OPT record in r.
+func setEDE(r, resp *dns.Msg, code uint16, extraText string) {
+	o := r.IsEdns0()
+	if o == nil {
+		return
+	}
+	if resp.IsEdns0() == nil {
+		resp.SetEdns0(o.UDPSize(), o.Do())
+	}
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: extraText})
+}
+
+// lookupEDE returns the Extended DNS Error code describing a failed upstream lookup.
+func lookupEDE(err error) uint16 {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return dns.ExtendedErrorCodeNetworkError
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return dns.ExtendedErrorCodeNetworkError
+	}
+	return dns.ExtendedErrorCodeNoReachableAuthority
+}
+
+// build returns the response to r for a blocked domain.
+func (b BlockResponse) build(r *dns.Msg) *dns.Msg {
+	var resp *dns.Msg
+	switch b.Style {
+	case BlockRefused:
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		return resp
+	case BlockNoData:
+		resp = buildResponse(r, dns.RcodeSuccess, nil)
+	case BlockNullIP:
+		resp = buildResponse(r, dns.RcodeSuccess, nullIPs)
+	case BlockSinkhole:
+		resp = buildResponse(r, dns.RcodeSuccess, b.IPs)
+	default:
+		resp = buildResponse(r, dns.RcodeNameError, nil)
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{soa(r.Question[0].Name)}
+	}
+	return resp
+}
+
+// buildResponse builds a reply to r carrying the ips matching the question type.
+func buildResponse(r *dns.Msg, rcodeStatus int, ips map[string][]string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	resp.Rcode = rcodeStatus
+
+	q := r.Question[0]
+	resp.Answer = addressRecords(q.Name, q.Qtype, ips)
+	return resp
+}
+
+// addressRecords returns the records of type qtype for owner built from ips.
+func addressRecords(owner string, qtype uint16, ips map[string][]string) []dns.RR {
+	var rrs []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		for _, ip := range ips["A"] {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   owner,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    answerTTL,
+				},
+				A: net.ParseIP(ip),
+			})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range ips["AAAA"] {
+			rrs = append(rrs, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   owner,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    answerTTL,
+				},
+				AAAA: net.ParseIP(ip),
+			})
+		}
+	}
+	return rrs
+}
+
+// soa returns a synthesized SOA record for zone, used in the authority
+// section of negative answers.
+func soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    answerTTL,
+		},
+		Ns:      "ns." + name + ".",
+		Mbox:    "hostmaster." + name + ".",
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  answerTTL,
+	}
+}
@@ -0,0 +1,63 @@
+package ainaa
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockResponse_Build(t *testing.T) {
+	sinkhole := BlockResponse{Style: BlockSinkhole, IPs: map[string][]string{"A": {"192.0.2.10"}}}
+
+	tests := []struct {
+		name          string
+		response      BlockResponse
+		qtype         uint16
+		expectedRcode int
+		expectedAns   string
+		expectedNs    int
+	}{
+		{name: "NXDOMAIN", response: BlockResponse{Style: BlockNXDomain}, qtype: dns.TypeA, expectedRcode: dns.RcodeNameError, expectedNs: 1},
+		{name: "NODATA", response: BlockResponse{Style: BlockNoData}, qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess, expectedNs: 1},
+		{name: "REFUSED", response: BlockResponse{Style: BlockRefused}, qtype: dns.TypeA, expectedRcode: dns.RcodeRefused},
+		{name: "Null A", response: BlockResponse{Style: BlockNullIP}, qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess, expectedAns: "0.0.0.0"},
+		{name: "Null AAAA", response: BlockResponse{Style: BlockNullIP}, qtype: dns.TypeAAAA, expectedRcode: dns.RcodeSuccess, expectedAns: "::"},
+		{name: "Null MX", response: BlockResponse{Style: BlockNullIP}, qtype: dns.TypeMX, expectedRcode: dns.RcodeSuccess, expectedNs: 1},
+		{name: "Sinkhole A", response: sinkhole, qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess, expectedAns: "192.0.2.10"},
+		{name: "Sinkhole AAAA Without IPv6", response: sinkhole, qtype: dns.TypeAAAA, expectedRcode: dns.RcodeSuccess, expectedNs: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion("blocked.example.", tt.qtype)
+
+			resp := tt.response.build(r)
+			if resp.Rcode != tt.expectedRcode {
+				t.Errorf("Expected Rcode %d, got %d", tt.expectedRcode, resp.Rcode)
+			}
+			if len(resp.Ns) != tt.expectedNs {
+				t.Errorf("Expected %d authority records, got %d", tt.expectedNs, len(resp.Ns))
+			}
+			if tt.expectedAns == "" {
+				if len(resp.Answer) != 0 {
+					t.Errorf("Expected no answer, got %v", resp.Answer)
+				}
+				return
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("Expected one answer, got %v", resp.Answer)
+			}
+			var got string
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			}
+			if got != tt.expectedAns {
+				t.Errorf("Expected answer %s, got %s", tt.expectedAns, got)
+			}
+		})
+	}
+}
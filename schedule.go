@@ -0,0 +1,174 @@
+package ainaa
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayout is how schedule exceptions are written.
+const dateLayout = "2006-01-02"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily time range on a set of weekdays. A window ending at or
+// before its start runs past midnight into the next day.
+type Window struct {
+	// Days holds the weekdays the window starts on, bit i set for time.Weekday(i).
+	Days uint8
+	// Start and End are minutes since midnight; End may be 24*60.
+	Start, End int
+}
+
+// DateRange is an inclusive range of dates, as "2006-01-02" strings.
+type DateRange struct {
+	From, To string
+}
+
+// Schedule is a named set of weekly windows in a time zone, during which the
+// rules referring to it apply.
+type Schedule struct {
+	Name     string
+	Location *time.Location
+	Windows  []Window
+	// Exceptions are dates on which no window starts, such as school holidays.
+	Exceptions []DateRange
+}
+
+// Active reports whether t falls in one of the windows of the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Format(dateLayout)
+	yesterday := t.AddDate(0, 0, -1)
+	for _, w := range s.Windows {
+		if w.Start < w.End {
+			if w.on(t.Weekday()) && minute >= w.Start && minute < w.End && !s.excepted(today) {
+				return true
+			}
+			continue
+		}
+		// The window runs past midnight: it is active late on its own days
+		// and early on the day after.
+		if w.on(t.Weekday()) && minute >= w.Start && !s.excepted(today) {
+			return true
+		}
+		if w.on(yesterday.Weekday()) && minute < w.End && !s.excepted(yesterday.Format(dateLayout)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) on(day time.Weekday) bool {
+	return w.Days&(1<<day) != 0
+}
+
+func (s *Schedule) excepted(date string) bool {
+	for _, r := range s.Exceptions {
+		if date >= r.From && date <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWindow parses "DAYS START-END", e.g. "sun-thu 22:00-07:00". DAYS is
+// "daily" or a comma separated list of days and day ranges.
+func parseWindow(args []string) (Window, error) {
+	if len(args) != 2 {
+		return Window{}, fmt.Errorf("schedule window needs days and a time range")
+	}
+	var w Window
+	days, err := parseDays(args[0])
+	if err != nil {
+		return Window{}, err
+	}
+	w.Days = days
+
+	start, end, ok := strings.Cut(args[1], "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid time range %q", args[1])
+	}
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, err
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return Window{}, err
+	}
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("empty time range %q", args[1])
+	}
+	if w.Start == 24*60 {
+		return Window{}, fmt.Errorf("time range %q starts at 24:00", args[1])
+	}
+	return w, nil
+}
+
+func parseDays(s string) (uint8, error) {
+	if s == "daily" {
+		return 0x7f, nil
+	}
+	var days uint8
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return 0, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return 0, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		// Ranges may wrap around the week, e.g. fri-mon.
+		for d := from; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight; "24:00" is the end
+// of the day.
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseDateRange parses "DATE" or "FROM/TO", dates written as 2006-01-02.
+func parseDateRange(s string) (DateRange, error) {
+	from, to, isRange := strings.Cut(s, "/")
+	if !isRange {
+		to = from
+	}
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return DateRange{}, fmt.Errorf("invalid date %q", date)
+		}
+	}
+	if to < from {
+		return DateRange{}, fmt.Errorf("date range %q ends before it starts", s)
+	}
+	return DateRange{From: from, To: to}, nil
+}
@@ -0,0 +1,96 @@
+package ainaa
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Active(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	nights, err := parseWindow([]string{"sun-thu", "22:00-07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	afternoons, err := parseWindow([]string{"sat,sun", "14:00-16:30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holidays, err := parseDateRange("2026-12-22/2027-01-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Schedule{
+		Name:       "school_nights",
+		Location:   paris,
+		Windows:    []Window{nights, afternoons},
+		Exceptions: []DateRange{holidays},
+	}
+
+	tests := []struct {
+		time     string
+		expected bool
+	}{
+		{time: "2026-10-18T22:00:00+02:00", expected: true},  // Sunday night
+		{time: "2026-10-19T06:59:00+02:00", expected: true},  // Monday morning
+		{time: "2026-10-19T07:00:00+02:00", expected: false}, // Monday, window over
+		{time: "2026-10-16T23:00:00+02:00", expected: false}, // Friday night
+		{time: "2026-10-17T06:00:00+02:00", expected: false}, // Saturday morning after Friday
+		{time: "2026-10-15T20:30:00Z", expected: true},       // Thursday 22:30 in Paris
+		{time: "2026-10-17T15:00:00+02:00", expected: true},  // Saturday afternoon
+		{time: "2026-10-17T16:30:00+02:00", expected: false},
+		{time: "2026-12-23T23:00:00+01:00", expected: false}, // holidays
+		{time: "2026-12-22T06:00:00+01:00", expected: true},  // night started before the holidays
+		{time: "2027-01-04T06:00:00+01:00", expected: false}, // night started on the last holiday
+		{time: "2027-01-04T22:00:00+01:00", expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.time, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Active(at); got != tt.expected {
+				t.Errorf("Expected active %t, got %t", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		args      []string
+		shouldErr bool
+		expected  Window
+	}{
+		{args: []string{"daily", "00:00-24:00"}, expected: Window{Days: 0x7f, Start: 0, End: 1440}},
+		{args: []string{"fri-mon", "20:30-06:00"}, expected: Window{Days: 1<<time.Friday | 1<<time.Saturday | 1<<time.Sunday | 1<<time.Monday, Start: 1230, End: 360}},
+		{args: []string{"Mon,wed", "08:00-12:00"}, expected: Window{Days: 1<<time.Monday | 1<<time.Wednesday, Start: 480, End: 720}},
+		{args: []string{"mon"}, shouldErr: true},
+		{args: []string{"monday", "08:00-12:00"}, shouldErr: true},
+		{args: []string{"mon", "08:00"}, shouldErr: true},
+		{args: []string{"mon", "08:00-08:00"}, shouldErr: true},
+		{args: []string{"mon", "24:00-08:00"}, shouldErr: true},
+		{args: []string{"mon", "08:60-09:00"}, shouldErr: true},
+		{args: []string{"mon", "8-9"}, shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args[0], func(t *testing.T) {
+			w, err := parseWindow(tt.args)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatalf("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+			if w != tt.expected {
+				t.Errorf("Expected window %+v, got %+v", tt.expected, w)
+			}
+		})
+	}
+}
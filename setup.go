@@ -2,44 +2,967 @@ package ainaa
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
 )
 
 func init() { plugin.Register(name, setup) }
 
-func setup(c *caddy.Controller) error {
-	c.Next()
-	if c.NextArg() {
-		return plugin.Error(name, c.ArgErr())
+// config holds the settings parsed from an ainaa block in the Corefile.
+type config struct {
+	redisAddr     string
+	redisPassword string
+	redisDB       int
+
+	dynamoTable    string
+	dynamoRegion   string
+	dynamoEndpoint string
+	profilesTable  string
+
+	resolvers   []string
+	classifiers []classifierConfig
+	strategy    Strategy
+	// threshold is the weighted strategy's threshold, zero for the default.
+	threshold   float64
+	blockStatus int
+	cacheTTL    time.Duration
+	// memoryCacheSize is how many domains are kept in process memory, zero
+	// disabling the memory cache.
+	memoryCacheSize int
+	memoryCacheTTL  time.Duration
+	// staleWindow is how long expired data is served, zero disabling it.
+	staleWindow time.Duration
+	prefetch    Prefetch
+	// negativeTTL and servfailTTL bound how long negative answers and
+	// failed lookups are cached, zero disabling it.
+	negativeTTL time.Duration
+	servfailTTL time.Duration
+	timeout     time.Duration
+	stagger     time.Duration
+	// healthCheck is how often upstreams are probed, zero disabling the
+	// probes and the breaker.
+	healthCheck time.Duration
+	maxFails    int
+	degraded    DegradedMode
+	// pins maps the names of encrypted upstreams to their public key pins.
+	pins       map[string][]string
+	filterOnly bool
+	allowlist  DomainList
+	// ipBlocklist holds the address ranges answers are filtered against.
+	ipBlocklist PrefixList
+	ipAction    IPAction
+
+	blockResponse BlockResponse
+	blockEDE      uint16
+	categories    map[int]Category
+	// blockStatusName is the category name given to block_status, if any.
+	blockStatusName string
+
+	clientIdentifiers []ClientIdentifier
+	schedules         map[string]*Schedule
+	profiles          []*Profile
+	// profileRecords collects the profile properties until the block is parsed.
+	profileRecords []*ProfileRecord
+}
+
+func newConfig() *config {
+	return &config{
+		redisAddr:      defaultRedisAddr,
+		dynamoTable:    defaultTableName,
+		blockStatus:    defaultBlockStatus,
+		cacheTTL:       defaultCacheTTL,
+		memoryCacheTTL: defaultMemoryCacheTTL,
+		negativeTTL:    defaultNegativeTTL,
+		servfailTTL:    defaultServfailTTL,
+		timeout:        defaultTimeout,
+		stagger:        defaultStagger,
+		healthCheck:    defaultHealthCheck,
+		maxFails:       defaultMaxFails,
+		allowlist:      DomainList{},
+		blockEDE:       dns.ExtendedErrorCodeBlocked,
+		categories:     map[int]Category{},
+	}
+}
+
+func setup(c *caddy.Controller) (err error) {
+	cfg, err := parseConfig(c)
+	if err != nil {
+		return plugin.Error(name, err)
 	}
 
 	// connect to redis
-	redisClient, err := connectRedis(context.Background())
+	redisClient, err := connectRedis(context.Background(), cfg)
 	if err != nil {
 		return plugin.Error(name, err)
 	}
-	redisRepo := NewRedisRepository(redisClient)
+	c.OnShutdown(func() error { return redisClient.Close() })
+	// Shutdown callbacks only run for instances that started.
+	defer func() {
+		if err != nil {
+			redisClient.Close()
+		}
+	}()
+	var cache CacheRepository = NewRedisRepository(redisClient)
+	if cfg.memoryCacheSize > 0 {
+		cache = NewMemoryCache(cache, cfg.memoryCacheSize, cfg.memoryCacheTTL)
+	}
 
 	// connect to dynamodb
-	dynamodbClient, err := connectDynamoDB(context.Background())
+	dynamodbClient, err := connectDynamoDB(context.Background(), cfg)
 	if err != nil {
 		return plugin.Error(name, err)
 	}
-	dynamoRepo := NewDynamoDBRepository(dynamodbClient)
+	dynamoRepo := NewDynamoDBRepository(dynamodbClient, cfg.dynamoTable)
+
+	var profileRepo ProfileRepository
+	if cfg.profilesTable != "" {
+		profileRepo = NewDynamoDBProfileRepository(dynamodbClient, cfg.profilesTable)
+	}
+	var profiles *Profiles
+	if len(cfg.profiles) > 0 || profileRepo != nil {
+		profiles, err = NewProfiles(cfg.profiles, cfg.categories, cfg.schedules, profileRepo)
+		if err != nil {
+			return plugin.Error(name, err)
+		}
+		if err := profiles.Reload(context.Background()); err != nil {
+			return plugin.Error(name, err)
+		}
+		if profileRepo != nil {
+			stop := make(chan struct{})
+			go profiles.refresh(profileRefresh, stop)
+			c.OnShutdown(func() error { close(stop); return nil })
+		}
+	}
 
-	resolver := &OpenDNSResolver{}
+	classifier, resolver, err := newClassifier(cfg)
+	if err != nil {
+		return plugin.Error(name, err)
+	}
+	upstreams := upstreamsOf(classifier, resolver)
+	c.OnShutdown(func() error {
+		for _, u := range upstreams {
+			u.Close()
+		}
+		return nil
+	})
+	if cfg.healthCheck > 0 {
+		stop := make(chan struct{})
+		for _, u := range upstreams {
+			go u.healthCheck(cfg.healthCheck, probeDNS, stop)
+		}
+		c.OnShutdown(func() error { close(stop); return nil })
+	}
+	var known *lastKnown
+	if cfg.degraded == DegradedStale {
+		known = newLastKnown(defaultLastKnownSize)
+	}
+
+	lookups, resolutions := newFlightGroup[verdict](), newFlightGroup[Resolution]()
+	refreshes := newFlightGroup[struct{}]()
+	var hits *hitCounter
+	if cfg.prefetch.Amount > 0 {
+		hits = newHitCounter(cfg.prefetch.Window)
+	}
+
+	for _, ci := range cfg.clientIdentifiers {
+		if ci.Source == clientSourceDoH {
+			// Let the DoH server accept the paths carrying a client ID.
+			dnsserver.GetConfig(c).HTTPRequestValidateFunc = validateDoHPath
+		}
+	}
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		return Ainaa{
-			Next:       next,
-			Cache:      redisRepo,
-			Persistent: dynamoRepo,
-			Resolver:   resolver,
+			Next:        next,
+			Cache:       cache,
+			Persistent:  dynamoRepo,
+			Resolver:    resolver,
+			Classifier:  classifier,
+			BlockStatus: cfg.blockStatus,
+			CacheTTL:    cfg.cacheTTL,
+			StaleWindow: cfg.staleWindow,
+			Prefetch:    cfg.prefetch,
+			NegativeTTL: cfg.negativeTTL,
+			ServfailTTL: cfg.servfailTTL,
+			Timeout:     cfg.timeout,
+			FilterOnly:  cfg.filterOnly,
+			Allowlist:   cfg.allowlist,
+
+			BlockResponse: cfg.blockResponse,
+			BlockEDE:      cfg.blockEDE,
+			Categories:    cfg.categories,
+			Profiles:      profiles,
+
+			ClientIdentifiers: cfg.clientIdentifiers,
+			Degraded:          cfg.degraded,
+			IPBlocklist:       cfg.ipBlocklist,
+			IPAction:          cfg.ipAction,
+			lastKnown:         known,
+			lookups:           lookups,
+			resolutions:       resolutions,
+			refreshes:         refreshes,
+			hits:              hits,
 		}
 	})
 
 	return nil
 }
+
+// newClassifier returns the classifier and the resolver configured in cfg.
+// Without a classifier, domains are classified by OpenDNS through the
+// resolver's servers; without resolver, addresses are looked up through the
+// servers of the first classifier. Several classifiers vote with the
+// configured strategy.
+func newClassifier(cfg *config) (Classifier, *OpenDNSResolver, error) {
+	configs := cfg.classifiers
+	if len(configs) == 0 {
+		configs = []classifierConfig{{provider: "opendns", servers: cfg.resolvers, weight: 1}}
+	}
+
+	consensus := &Consensus{Strategy: cfg.strategy, Threshold: cfg.threshold}
+	if consensus.Threshold == 0 {
+		consensus.Threshold = defaultThreshold
+	}
+	opts := UpstreamOptions{Stagger: cfg.stagger, MaxFails: cfg.maxFails, Pins: cfg.pins}
+	if cfg.healthCheck == 0 {
+		// Without probes, upstreams marked down would never come back.
+		opts.MaxFails = 0
+	}
+	for _, cc := range configs {
+		c, err := NewDNSClassifier(cc.provider, cc.servers, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		consensus.Classifiers = append(consensus.Classifiers, WeightedClassifier{Classifier: c, Weight: cc.weight})
+	}
+
+	// Without resolvers of its own, the resolver shares the upstreams, and
+	// their latencies, of the first classifier.
+	resolver := &OpenDNSResolver{Upstreams: consensus.Classifiers[0].Classifier.(*DNSClassifier).Upstreams}
+	if len(cfg.resolvers) > 0 {
+		resolver.Upstreams = NewUpstreams(cfg.resolvers, opts)
+	}
+	if len(consensus.Classifiers) == 1 {
+		return consensus.Classifiers[0].Classifier, resolver, nil
+	}
+	return consensus, resolver, nil
+}
+
+// upstreamsOf returns every set of upstreams used by classifier and resolver,
+// each once.
+func upstreamsOf(classifier Classifier, resolver *OpenDNSResolver) []*Upstreams {
+	var classifiers []Classifier
+	if consensus, ok := classifier.(*Consensus); ok {
+		for _, wc := range consensus.Classifiers {
+			classifiers = append(classifiers, wc.Classifier)
+		}
+	} else {
+		classifiers = append(classifiers, classifier)
+	}
+
+	var all []*Upstreams
+	add := func(u *Upstreams) {
+		if !slices.Contains(all, u) {
+			all = append(all, u)
+		}
+	}
+	for _, c := range classifiers {
+		if dc, ok := c.(*DNSClassifier); ok {
+			add(dc.Upstreams)
+		}
+	}
+	add(resolver.Upstreams)
+	return all
+}
+
+func parseConfig(c *caddy.Controller) (*config, error) {
+	cfg := newConfig()
+
+	i := 0
+	for c.Next() {
+		if i > 0 {
+			return nil, plugin.ErrOnce
+		}
+		i++
+
+		if len(c.RemainingArgs()) > 0 {
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			if err := parseBlock(c, cfg); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, schedule := range cfg.schedules {
+			if len(schedule.Windows) == 0 {
+				return nil, c.Errf("schedule %s has no window", schedule.Name)
+			}
+		}
+
+		for _, rec := range cfg.profileRecords {
+			profile, err := newProfile(*rec, cfg.categories, cfg.schedules)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			cfg.profiles = append(cfg.profiles, profile)
+		}
+		cfg.profileRecords = nil
+		if _, err := NewProfiles(cfg.profiles, cfg.categories, cfg.schedules, nil); err != nil {
+			return nil, c.Err(err.Error())
+		}
+
+		if cfg.blockStatusName != "" {
+			status, ok := categoryStatus(cfg.categories, cfg.blockStatusName)
+			if !ok {
+				return nil, c.Errf("block_status refers to unknown category %q", cfg.blockStatusName)
+			}
+			cfg.blockStatus = status
+			cfg.blockStatusName = ""
+		}
+	}
+	return cfg, nil
+}
+
+// categoryStatus returns the status of the category called name.
+func categoryStatus(categories map[int]Category, name string) (int, bool) {
+	for status, cat := range categories {
+		if cat.Name == name {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+func parseBlock(c *caddy.Controller, cfg *config) error {
+	switch c.Val() {
+	case "redis":
+		return parseRedis(c, cfg)
+	case "dynamodb":
+		return parseDynamoDB(c, cfg)
+	case "resolver":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		servers, err := parseUpstreams(args)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cfg.resolvers = servers
+	case "classifier":
+		cc, err := parseClassifier(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		for _, other := range cfg.classifiers {
+			if other.provider == cc.provider {
+				return c.Errf("classifier %s is configured twice", cc.provider)
+			}
+		}
+		cfg.classifiers = append(cfg.classifiers, cc)
+	case "consensus":
+		strategy, threshold, err := parseStrategy(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cfg.strategy, cfg.threshold = strategy, threshold
+	case "block_status":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		status, err := strconv.Atoi(c.Val())
+		if err != nil {
+			// A category name, resolved once the whole block is parsed.
+			cfg.blockStatusName = c.Val()
+		} else if status <= 0 {
+			return c.Errf("block_status must be greater than zero, got %d", status)
+		} else {
+			cfg.blockStatus = status
+			cfg.blockStatusName = ""
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "cache_ttl":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		ttl, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid cache_ttl %q: %v", c.Val(), err)
+		}
+		if ttl <= 0 {
+			return c.Errf("cache_ttl must be positive, got %s", ttl)
+		}
+		cfg.cacheTTL = ttl
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		timeout, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid timeout %q: %v", c.Val(), err)
+		}
+		if timeout < 0 {
+			return c.Errf("timeout cannot be negative, got %s", timeout)
+		}
+		cfg.timeout = timeout
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "stagger":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		stagger, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid stagger %q: %v", c.Val(), err)
+		}
+		if stagger < 0 {
+			return c.Errf("stagger cannot be negative, got %s", stagger)
+		}
+		cfg.stagger = stagger
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "serve_stale":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		cfg.staleWindow = defaultStaleWindow
+		if len(args) == 1 {
+			window, err := time.ParseDuration(args[0])
+			if err != nil {
+				return c.Errf("invalid serve_stale duration %q: %v", args[0], err)
+			}
+			if window < 0 {
+				return c.Errf("serve_stale duration cannot be negative, got %s", window)
+			}
+			cfg.staleWindow = window
+		}
+	case "negative_ttl", "servfail_ttl":
+		property := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		ttl, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return c.Errf("invalid %s %q: %v", property, c.Val(), err)
+		}
+		if ttl < 0 {
+			return c.Errf("%s cannot be negative, got %s", property, ttl)
+		}
+		if property == "negative_ttl" {
+			cfg.negativeTTL = ttl
+		} else {
+			cfg.servfailTTL = ttl
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "prefetch":
+		p, err := parsePrefetch(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cfg.prefetch = p
+	case "memory_cache":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		cfg.memoryCacheSize = defaultMemoryCacheSize
+		if len(args) == 0 {
+			break
+		}
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size < 0 {
+			return c.Errf("invalid memory_cache size %q, expected a number of domains", args[0])
+		}
+		cfg.memoryCacheSize = size
+		if len(args) == 2 {
+			ttl, err := time.ParseDuration(args[1])
+			if err != nil {
+				return c.Errf("invalid memory_cache ttl %q: %v", args[1], err)
+			}
+			if ttl <= 0 {
+				return c.Errf("memory_cache ttl must be positive, got %s", ttl)
+			}
+			cfg.memoryCacheTTL = ttl
+		}
+	case "health_check":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		interval, err := time.ParseDuration(args[0])
+		if err != nil {
+			return c.Errf("invalid health_check interval %q: %v", args[0], err)
+		}
+		if interval < 0 {
+			return c.Errf("health_check interval cannot be negative, got %s", interval)
+		}
+		cfg.healthCheck = interval
+		if len(args) == 2 {
+			maxFails, err := strconv.Atoi(args[1])
+			if err != nil || maxFails <= 0 {
+				return c.Errf("invalid health_check failures %q, expected a positive number", args[1])
+			}
+			cfg.maxFails = maxFails
+		}
+	case "tls_pin":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		for _, p := range args[1:] {
+			if b, err := base64.StdEncoding.DecodeString(p); err != nil || len(b) != sha256.Size {
+				return c.Errf("invalid pin %q for %s, expected a base64 SHA-256 hash", p, args[0])
+			}
+		}
+		if cfg.pins == nil {
+			cfg.pins = map[string][]string{}
+		}
+		cfg.pins[args[0]] = append(cfg.pins[args[0]], args[1:]...)
+	case "degraded":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		mode, ok := degradedModes[c.Val()]
+		if !ok {
+			return c.Errf("unknown degraded mode %q, expected stale, allow or block", c.Val())
+		}
+		cfg.degraded = mode
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "mode":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "resolve":
+			cfg.filterOnly = false
+		case "filter":
+			cfg.filterOnly = true
+		default:
+			return c.Errf("unknown mode %q, expected resolve or filter", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "allow":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, domain := range args {
+			if err := cfg.allowlist.Add(domain); err != nil {
+				return c.Err(err.Error())
+			}
+		}
+	case "allowlist":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		path := c.Val()
+		if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(path) && root != "" {
+			path = filepath.Join(root, path)
+		}
+		if err := cfg.allowlist.Load(path); err != nil {
+			return c.Errf("unable to load allowlist: %v", err)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "ip_block":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, prefix := range args {
+			if err := cfg.ipBlocklist.Add(prefix); err != nil {
+				return c.Err(err.Error())
+			}
+		}
+	case "ip_blocklist":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		path := c.Val()
+		if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(path) && root != "" {
+			path = filepath.Join(root, path)
+		}
+		if err := cfg.ipBlocklist.Load(path); err != nil {
+			return c.Errf("unable to load IP blocklist: %v", err)
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "ip_action":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		action, ok := ipActions[c.Val()]
+		if !ok {
+			return c.Errf("unknown IP action %q, expected block or strip", c.Val())
+		}
+		cfg.ipAction = action
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "block_response":
+		return parseBlockResponseProperty(c, cfg)
+	case "category":
+		return parseCategoryProperty(c, cfg)
+	case "profile":
+		return parseProfileProperty(c, cfg)
+	case "schedule":
+		return parseScheduleProperty(c, cfg)
+	case "client_id":
+		ci, err := parseClientIdentifier(c.RemainingArgs())
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		cfg.clientIdentifiers = append(cfg.clientIdentifiers, ci)
+	case "ede":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if c.Val() == "off" {
+			cfg.blockEDE = 0
+		} else if code, ok := edeCodes[c.Val()]; ok {
+			cfg.blockEDE = code
+		} else {
+			return c.Errf("unknown ede %q, expected blocked, filtered, censored or off", c.Val())
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	default:
+		return c.Errf("unknown property %q", c.Val())
+	}
+	return nil
+}
+
+// parsePrefetch parses "AMOUNT [DURATION] [PERCENTAGE%]".
+func parsePrefetch(args []string) (Prefetch, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return Prefetch{}, fmt.Errorf("prefetch needs an amount, optionally followed by a duration and a percentage")
+	}
+	p := Prefetch{Window: defaultPrefetchWindow, Percentage: defaultPrefetchPercentage}
+	amount, err := strconv.Atoi(args[0])
+	if err != nil || amount <= 0 {
+		return Prefetch{}, fmt.Errorf("invalid prefetch amount %q, expected a positive number", args[0])
+	}
+	p.Amount = amount
+	for _, arg := range args[1:] {
+		if pct, ok := strings.CutSuffix(arg, "%"); ok {
+			n, err := strconv.Atoi(pct)
+			if err != nil || n < 0 || n > 100 {
+				return Prefetch{}, fmt.Errorf("invalid prefetch percentage %q, expected 0%% to 100%%", arg)
+			}
+			p.Percentage = n
+			continue
+		}
+		window, err := time.ParseDuration(arg)
+		if err != nil || window <= 0 {
+			return Prefetch{}, fmt.Errorf("invalid prefetch duration %q", arg)
+		}
+		p.Window = window
+	}
+	return p, nil
+}
+
+// parseUpstreams parses upstream addresses: IP addresses with an optional
+// port or resolv.conf-like files, for plain DNS, or addresses prefixed with
+// tls://, quic:// or https://. Encrypted upstreams may be followed by
+// "servername NAME", the name their certificate is checked against instead of
+// their address, which is kept after the address as in tls://192.0.2.53:853#NAME.
+func parseUpstreams(args []string) ([]string, error) {
+	var servers []string
+	for len(args) > 0 {
+		addr := args[0]
+		args = args[1:]
+		trans, _ := parse.Transport(addr)
+		var ss []string
+		switch trans {
+		case transport.DNS, transport.TLS, transport.QUIC:
+			var err error
+			if ss, err = parse.HostPortOrFile(addr); err != nil {
+				return nil, err
+			}
+		case transport.HTTPS:
+			u, err := parseDoHURL(addr)
+			if err != nil {
+				return nil, err
+			}
+			ss = []string{u}
+		default:
+			return nil, fmt.Errorf("unsupported upstream transport %q", trans)
+		}
+		if len(args) > 0 && args[0] == "servername" {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("missing server name of %s", addr)
+			}
+			serverName := args[1]
+			args = args[2:]
+			if trans == transport.DNS {
+				return nil, fmt.Errorf("server name %q of %s needs an encrypted transport", serverName, addr)
+			}
+			if _, ok := dns.IsDomainName(serverName); !ok {
+				return nil, fmt.Errorf("invalid server name %q of %s", serverName, addr)
+			}
+			for i := range ss {
+				ss[i] += "#" + strings.TrimSuffix(serverName, ".")
+			}
+		}
+		servers = append(servers, ss...)
+	}
+	return servers, nil
+}
+
+// parseDoHURL parses the URL of a DNS-over-HTTPS upstream, whose host must be
+// an IP address, the path defaulting to /dns-query.
+func parseDoHURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid DoH upstream %q: %v", s, err)
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		return "", fmt.Errorf("DoH upstream %q must be an IP address", s)
+	}
+	if u.Path == "" {
+		u.Path = dohPath
+	}
+	return u.String(), nil
+}
+
+// parseRedis parses "redis ADDRESS [password PASSWORD] [db N]".
+func parseRedis(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args)%2 == 0 {
+		return c.ArgErr()
+	}
+	cfg.redisAddr = args[0]
+	for i := 1; i < len(args); i += 2 {
+		key, val := args[i], args[i+1]
+		switch key {
+		case "password":
+			cfg.redisPassword = val
+		case "db":
+			db, err := strconv.Atoi(val)
+			if err != nil || db < 0 {
+				return c.Errf("invalid redis db %q", val)
+			}
+			cfg.redisDB = db
+		default:
+			return c.Errf("unknown redis option %q", key)
+		}
+	}
+	return nil
+}
+
+// parseDynamoDB parses "dynamodb [table TABLE] [region REGION] [endpoint URL] [profiles TABLE]".
+func parseDynamoDB(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args)%2 != 0 {
+		return c.ArgErr()
+	}
+	for i := 0; i < len(args); i += 2 {
+		key, val := args[i], args[i+1]
+		switch key {
+		case "table":
+			cfg.dynamoTable = val
+		case "region":
+			cfg.dynamoRegion = val
+		case "endpoint":
+			cfg.dynamoEndpoint = val
+		case "profiles":
+			cfg.profilesTable = val
+		default:
+			return c.Errf("unknown dynamodb option %q", key)
+		}
+	}
+	if cfg.dynamoTable == "" {
+		return c.Err("dynamodb table name cannot be empty")
+	}
+	return nil
+}
+
+// parseBlockResponseProperty parses "block_response [STATUS] STYLE [ADDRESS...]".
+func parseBlockResponseProperty(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	status, err := strconv.Atoi(args[0])
+	hasStatus := err == nil
+	if hasStatus {
+		if status <= 0 {
+			return c.Errf("block_response status must be greater than zero, got %d", status)
+		}
+		args = args[1:]
+	}
+
+	br, err := parseBlockResponse(args)
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	if hasStatus {
+		cat, ok := cfg.categories[status]
+		if !ok {
+			cat = Category{Action: ActionBlock}
+		}
+		cat.Response = &br
+		cfg.categories[status] = cat
+	} else {
+		cfg.blockResponse = br
+	}
+	return nil
+}
+
+// parseCategoryProperty parses "category STATUS NAME ACTION [ARGS...]".
+func parseCategoryProperty(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	status, err := strconv.Atoi(args[0])
+	if err != nil || status <= 0 {
+		return c.Errf("category status must be a number greater than zero, got %q", args[0])
+	}
+	cat, err := parseCategory(args[1:])
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	if other, ok := categoryStatus(cfg.categories, cat.Name); ok && other != status {
+		return c.Errf("category %q is already defined for status %d", cat.Name, other)
+	}
+	// Keep a response set earlier with block_response STATUS.
+	if old, ok := cfg.categories[status]; ok && cat.Action == ActionBlock && cat.Response == nil {
+		cat.Response = old.Response
+	}
+	cfg.categories[status] = cat
+	return nil
+}
+
+// parseProfileProperty parses "profile NAME PROPERTY ARGS...". Properties of
+// the same profile may be spread over several lines.
+func parseProfileProperty(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	profileName, property, values := args[0], args[1], args[2:]
+
+	var rec *ProfileRecord
+	for _, r := range cfg.profileRecords {
+		if r.Name == profileName {
+			rec = r
+		}
+	}
+	if rec == nil {
+		rec = &ProfileRecord{Name: profileName}
+		cfg.profileRecords = append(cfg.profileRecords, rec)
+	}
+
+	switch property {
+	case "networks":
+		rec.Networks = append(rec.Networks, values...)
+	case "clients":
+		rec.Clients = append(rec.Clients, values...)
+	case "block_categories":
+		rec.BlockCategories = append(rec.BlockCategories, values...)
+	case "allow_categories":
+		rec.AllowCategories = append(rec.AllowCategories, values...)
+	case "log_categories":
+		rec.LogCategories = append(rec.LogCategories, values...)
+	case "allow":
+		rec.Allow = append(rec.Allow, values...)
+	case "deny":
+		rec.Deny = append(rec.Deny, values...)
+	case "block_response":
+		rec.BlockResponse = strings.Join(values, " ")
+	case "schedule":
+		if len(values) != 1 {
+			return c.ArgErr()
+		}
+		rec.Schedule = values[0]
+	case "scheduled":
+		rec.Scheduled = append(rec.Scheduled, strings.Join(values, " "))
+	default:
+		return c.Errf("unknown profile property %q", property)
+	}
+	return nil
+}
+
+// parseScheduleProperty parses "schedule NAME PROPERTY ARGS...". Properties
+// of the same schedule may be spread over several lines.
+func parseScheduleProperty(c *caddy.Controller, cfg *config) error {
+	args := c.RemainingArgs()
+	if len(args) < 3 {
+		return c.ArgErr()
+	}
+	scheduleName, property, values := args[0], args[1], args[2:]
+
+	if cfg.schedules == nil {
+		cfg.schedules = make(map[string]*Schedule)
+	}
+	schedule, ok := cfg.schedules[scheduleName]
+	if !ok {
+		schedule = &Schedule{Name: scheduleName, Location: time.Local}
+		cfg.schedules[scheduleName] = schedule
+	}
+
+	switch property {
+	case "timezone":
+		if len(values) != 1 {
+			return c.ArgErr()
+		}
+		loc, err := time.LoadLocation(values[0])
+		if err != nil {
+			return c.Errf("invalid timezone for schedule %s: %v", scheduleName, err)
+		}
+		schedule.Location = loc
+	case "window":
+		w, err := parseWindow(values)
+		if err != nil {
+			return c.Errf("schedule %s: %v", scheduleName, err)
+		}
+		schedule.Windows = append(schedule.Windows, w)
+	case "except":
+		for _, v := range values {
+			r, err := parseDateRange(v)
+			if err != nil {
+				return c.Errf("schedule %s: %v", scheduleName, err)
+			}
+			schedule.Exceptions = append(schedule.Exceptions, r)
+		}
+	default:
+		return c.Errf("unknown schedule property %q", property)
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package ainaa
 
 import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 func TestSetup_ArgsFail(t *testing.T) {
@@ -14,27 +20,407 @@ func TestSetup_ArgsFail(t *testing.T) {
 }
 
 func TestSetup_RedisFail(t *testing.T) {
-	t.Setenv("REDIS_ADDR", "fake")
-	c := caddy.NewTestController("dns", `ainaa`)
+	c := caddy.NewTestController("dns", `ainaa {
+		redis fake
+	}`)
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected an error, but got none")
 	}
 }
 
 func TestSetup_DynamoDBFail(t *testing.T) {
-	t.Setenv("REDIS_ADDR", "localhost:6379")
-	c := caddy.NewTestController("dns", `ainaa`)
+	c := caddy.NewTestController("dns", `ainaa {
+		redis localhost:6379
+	}`)
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected an error, but got none")
 	}
 }
+
 func TestSetup_Success(t *testing.T) {
-	t.Setenv("REDIS_ADDR", "localhost:6379")
 	t.Setenv("AWS_ACCESS_KEY_ID", "fake")
 	t.Setenv("AWS_SECRET_ACCESS_KEY", "fake")
-	t.Setenv("AWS_REGION", "us-west-2")
-	c := caddy.NewTestController("dns", `ainaa`)
+	c := caddy.NewTestController("dns", `ainaa {
+		redis localhost:6379
+		dynamodb table AinaaDomains region us-west-2
+	}`)
 	if err := setup(c); err != nil {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 }
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		shouldErr bool
+		expected  *config
+	}{
+		{
+			name:     "Defaults",
+			input:    `ainaa`,
+			expected: newConfig(),
+		},
+		{
+			name: "Full Block",
+			input: `ainaa {
+				redis 10.0.0.1:6379 password secret db 2
+				dynamodb table Domains region eu-west-1 endpoint http://localhost:8000
+				resolver 1.1.1.3 1.0.0.3:5353
+				block_status 4
+				cache_ttl 10m
+				memory_cache 500 30s
+				negative_ttl 1m
+				servfail_ttl 10s
+				timeout 2s
+				stagger 100ms
+				health_check 30s 5
+				degraded block
+				mode filter
+				allow partner.com Internal.Example.
+				block_response nodata
+				block_response 3 refused
+				ede filtered
+				category 1 malware block
+				category 2 adult block null
+				category 3 gambling block
+				category 4 ads redirect 192.0.2.53
+				category 5 search redirect ForceSafeSearch.example.com
+				category 6 social log
+				category 7 news allow
+				block_status malware
+			}`,
+			expected: &config{
+				redisAddr:       "10.0.0.1:6379",
+				redisPassword:   "secret",
+				redisDB:         2,
+				dynamoTable:     "Domains",
+				dynamoRegion:    "eu-west-1",
+				dynamoEndpoint:  "http://localhost:8000",
+				resolvers:       []string{"1.1.1.3:53", "1.0.0.3:5353"},
+				blockStatus:     1,
+				cacheTTL:        10 * time.Minute,
+				memoryCacheSize: 500,
+				memoryCacheTTL:  30 * time.Second,
+				negativeTTL:     time.Minute,
+				servfailTTL:     10 * time.Second,
+				timeout:         2 * time.Second,
+				stagger:         100 * time.Millisecond,
+				healthCheck:     30 * time.Second,
+				maxFails:        5,
+				degraded:        DegradedBlock,
+				filterOnly:      true,
+				allowlist:       DomainList{"partner.com": {}, "internal.example": {}},
+				blockResponse:   BlockResponse{Style: BlockNoData},
+				categories: map[int]Category{
+					1: {Name: "malware", Action: ActionBlock},
+					2: {Name: "adult", Action: ActionBlock, Response: &BlockResponse{Style: BlockNullIP}},
+					3: {Name: "gambling", Action: ActionBlock, Response: &BlockResponse{Style: BlockRefused}},
+					4: {Name: "ads", Action: ActionRedirect, Response: &BlockResponse{Style: BlockSinkhole, IPs: map[string][]string{"A": {"192.0.2.53"}}}},
+					5: {Name: "search", Action: ActionRedirect, Target: "forcesafesearch.example.com."},
+					6: {Name: "social", Action: ActionLog},
+					7: {Name: "news", Action: ActionAllow},
+				},
+				blockEDE: dns.ExtendedErrorCodeFiltered,
+			},
+		},
+		{name: "Argument", input: `ainaa arg`, shouldErr: true},
+		{name: "Unknown Property", input: "ainaa {\nfoo bar\n}", shouldErr: true},
+		{name: "Redis Missing Address", input: "ainaa {\nredis\n}", shouldErr: true},
+		{name: "Redis Unknown Option", input: "ainaa {\nredis localhost:6379 user bob\n}", shouldErr: true},
+		{name: "Redis Invalid DB", input: "ainaa {\nredis localhost:6379 db x\n}", shouldErr: true},
+		{name: "DynamoDB Odd Args", input: "ainaa {\ndynamodb table\n}", shouldErr: true},
+		{name: "DynamoDB Unknown Option", input: "ainaa {\ndynamodb bucket x\n}", shouldErr: true},
+		{name: "Resolver Missing Address", input: "ainaa {\nresolver\n}", shouldErr: true},
+		{name: "Resolver Invalid Address", input: "ainaa {\nresolver not-an-ip\n}", shouldErr: true},
+		{name: "Resolver Unsupported Transport", input: "ainaa {\nresolver grpc://1.1.1.1\n}", shouldErr: true},
+		{name: "Resolver Encrypted", input: "ainaa {\nresolver tls://1.1.1.1 servername cloudflare-dns.com quic://94.140.14.14:8853 https://9.9.9.9 servername dns.quad9.net https://[2606:4700::1111]:8443/resolve\n}", expected: func() *config {
+			c := newConfig()
+			c.resolvers = []string{
+				"tls://1.1.1.1:853#cloudflare-dns.com",
+				"quic://94.140.14.14:8853",
+				"https://9.9.9.9/dns-query#dns.quad9.net",
+				"https://[2606:4700::1111]:8443/resolve",
+			}
+			return c
+		}()},
+		{name: "Resolver DoH Hostname", input: "ainaa {\nresolver https://dns.google/dns-query\n}", shouldErr: true},
+		{name: "Resolver Plain Server Name", input: "ainaa {\nresolver 1.1.1.1 servername cloudflare-dns.com\n}", shouldErr: true},
+		{name: "Resolver Missing Server Name", input: "ainaa {\nresolver tls://1.1.1.1 servername\n}", shouldErr: true},
+		{name: "TLS Pin", input: "ainaa {\ntls_pin dns.quad9.net /SlsviBkb05Y/8XiKF9+CZsgCtrqPQk5bh47o0R3/Cg= 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n}", expected: func() *config {
+			c := newConfig()
+			c.pins = map[string][]string{"dns.quad9.net": {"/SlsviBkb05Y/8XiKF9+CZsgCtrqPQk5bh47o0R3/Cg=", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}
+			return c
+		}()},
+		{name: "TLS Pin Missing", input: "ainaa {\ntls_pin dns.quad9.net\n}", shouldErr: true},
+		{name: "TLS Pin Invalid", input: "ainaa {\ntls_pin dns.quad9.net c2hvcnQ=\n}", shouldErr: true},
+		{name: "Classifier", input: "ainaa {\nclassifier quad9\n}", expected: func() *config {
+			c := newConfig()
+			c.classifiers = []classifierConfig{{provider: "quad9", weight: 1}}
+			return c
+		}()},
+		{name: "Classifier Servers", input: "ainaa {\nclassifier cloudflare 1.1.1.3 1.0.0.3:5353\n}", expected: func() *config {
+			c := newConfig()
+			c.classifiers = []classifierConfig{{provider: "cloudflare", servers: []string{"1.1.1.3:53", "1.0.0.3:5353"}, weight: 1}}
+			return c
+		}()},
+		{name: "Classifier Consensus", input: "ainaa {\nclassifier quad9 weight 2\nclassifier opendns 208.67.222.222 weight 0.5\nclassifier adguard\nconsensus weighted 0.6\n}", expected: func() *config {
+			c := newConfig()
+			c.classifiers = []classifierConfig{
+				{provider: "quad9", weight: 2},
+				{provider: "opendns", servers: []string{"208.67.222.222:53"}, weight: 0.5},
+				{provider: "adguard", weight: 1},
+			}
+			c.strategy, c.threshold = StrategyWeighted, 0.6
+			return c
+		}()},
+		{name: "Classifier Twice", input: "ainaa {\nclassifier quad9\nclassifier quad9 9.9.9.11\n}", shouldErr: true},
+		{name: "Classifier Invalid Weight", input: "ainaa {\nclassifier quad9 weight -1\n}", shouldErr: true},
+		{name: "Consensus Missing Strategy", input: "ainaa {\nconsensus\n}", shouldErr: true},
+		{name: "Consensus Unknown Strategy", input: "ainaa {\nconsensus quorum\n}", shouldErr: true},
+		{name: "Consensus Threshold Without Weights", input: "ainaa {\nconsensus majority 0.5\n}", shouldErr: true},
+		{name: "Consensus Invalid Threshold", input: "ainaa {\nconsensus weighted 1.5\n}", shouldErr: true},
+		{name: "Classifier Missing Provider", input: "ainaa {\nclassifier\n}", shouldErr: true},
+		{name: "Classifier Unknown Provider", input: "ainaa {\nclassifier google\n}", shouldErr: true},
+		{name: "Classifier Unsupported Transport", input: "ainaa {\nclassifier quad9 grpc://9.9.9.9\n}", shouldErr: true},
+		{name: "Block Status Zero", input: "ainaa {\nblock_status 0\n}", shouldErr: true},
+		{name: "Block Status Invalid", input: "ainaa {\nblock_status bad\n}", shouldErr: true},
+		{name: "Cache TTL Invalid", input: "ainaa {\ncache_ttl forever\n}", shouldErr: true},
+		{name: "Cache TTL Negative", input: "ainaa {\ncache_ttl -1m\n}", shouldErr: true},
+		{name: "Timeout Off", input: "ainaa {\ntimeout 0s\n}", expected: func() *config { c := newConfig(); c.timeout = 0; return c }()},
+		{name: "Timeout Invalid", input: "ainaa {\ntimeout soon\n}", shouldErr: true},
+		{name: "Timeout Negative", input: "ainaa {\ntimeout -1s\n}", shouldErr: true},
+		{name: "Stagger Parallel", input: "ainaa {\nstagger 0s\n}", expected: func() *config { c := newConfig(); c.stagger = 0; return c }()},
+		{name: "Stagger Invalid", input: "ainaa {\nstagger later\n}", shouldErr: true},
+		{name: "Health Check Off", input: "ainaa {\nhealth_check 0s\n}", expected: func() *config { c := newConfig(); c.healthCheck = 0; return c }()},
+		{name: "Health Check Missing", input: "ainaa {\nhealth_check\n}", shouldErr: true},
+		{name: "Health Check Negative", input: "ainaa {\nhealth_check -1s\n}", shouldErr: true},
+		{name: "Health Check Invalid Failures", input: "ainaa {\nhealth_check 10s 0\n}", shouldErr: true},
+		{name: "Degraded Allow", input: "ainaa {\ndegraded allow\n}", expected: func() *config { c := newConfig(); c.degraded = DegradedAllow; return c }()},
+		{name: "Degraded Unknown", input: "ainaa {\ndegraded servfail\n}", shouldErr: true},
+		{name: "IP Block", input: "ainaa {\nip_block 192.0.2.0/24 2001:db8::1 ::ffff:198.51.100.0/120\nip_action strip\n}", expected: func() *config {
+			c := newConfig()
+			c.ipBlocklist = PrefixList{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::1/128"), netip.MustParsePrefix("198.51.100.0/24")}
+			c.ipAction = IPActionStrip
+			return c
+		}()},
+		{name: "Serve Stale", input: "ainaa {\nserve_stale\n}", expected: func() *config { c := newConfig(); c.staleWindow = defaultStaleWindow; return c }()},
+		{name: "Serve Stale Window", input: "ainaa {\nserve_stale 24h\n}", expected: func() *config { c := newConfig(); c.staleWindow = 24 * time.Hour; return c }()},
+		{name: "Serve Stale Invalid", input: "ainaa {\nserve_stale forever\n}", shouldErr: true},
+		{name: "Serve Stale Two Durations", input: "ainaa {\nserve_stale 1h 2h\n}", shouldErr: true},
+		{name: "Negative TTL Disabled", input: "ainaa {\nnegative_ttl 0\n}", expected: func() *config { c := newConfig(); c.negativeTTL = 0; return c }()},
+		{name: "Negative TTL Invalid", input: "ainaa {\nnegative_ttl forever\n}", shouldErr: true},
+		{name: "Servfail TTL Negative", input: "ainaa {\nservfail_ttl -1s\n}", shouldErr: true},
+		{name: "Servfail TTL Two Durations", input: "ainaa {\nservfail_ttl 1s 2s\n}", shouldErr: true},
+		{name: "Prefetch", input: "ainaa {\nprefetch 10\n}", expected: func() *config {
+			c := newConfig()
+			c.prefetch = Prefetch{Amount: 10, Window: defaultPrefetchWindow, Percentage: defaultPrefetchPercentage}
+			return c
+		}()},
+		{name: "Prefetch Window Percentage", input: "ainaa {\nprefetch 5 5m 20%\n}", expected: func() *config {
+			c := newConfig()
+			c.prefetch = Prefetch{Amount: 5, Window: 5 * time.Minute, Percentage: 20}
+			return c
+		}()},
+		{name: "Prefetch No Amount", input: "ainaa {\nprefetch\n}", shouldErr: true},
+		{name: "Prefetch Zero Amount", input: "ainaa {\nprefetch 0\n}", shouldErr: true},
+		{name: "Prefetch Invalid Percentage", input: "ainaa {\nprefetch 5 150%\n}", shouldErr: true},
+		{name: "Prefetch Invalid Duration", input: "ainaa {\nprefetch 5 soon\n}", shouldErr: true},
+		{name: "Memory Cache Off", input: "ainaa {\nmemory_cache 0\n}", expected: func() *config { c := newConfig(); c.memoryCacheSize = 0; return c }()},
+		{name: "Memory Cache", input: "ainaa {\nmemory_cache\n}", expected: func() *config { c := newConfig(); c.memoryCacheSize = defaultMemoryCacheSize; return c }()},
+		{name: "Memory Cache Negative Size", input: "ainaa {\nmemory_cache -1\n}", shouldErr: true},
+		{name: "Memory Cache Zero TTL", input: "ainaa {\nmemory_cache 100 0s\n}", shouldErr: true},
+		{name: "IP Block Missing Prefix", input: "ainaa {\nip_block\n}", shouldErr: true},
+		{name: "IP Block Invalid Prefix", input: "ainaa {\nip_block 192.0.2.0/33\n}", shouldErr: true},
+		{name: "IP Blocklist Missing File", input: "ainaa {\nip_blocklist /nonexistent/ips.txt\n}", shouldErr: true},
+		{name: "IP Action Unknown", input: "ainaa {\nip_action drop\n}", shouldErr: true},
+		{name: "Mode Unknown", input: "ainaa {\nmode proxy\n}", shouldErr: true},
+		{name: "Mode Missing", input: "ainaa {\nmode\n}", shouldErr: true},
+		{name: "Allow Missing Domain", input: "ainaa {\nallow\n}", shouldErr: true},
+		{name: "Allow Invalid Domain", input: "ainaa {\nallow bad..domain\n}", shouldErr: true},
+		{name: "Allowlist Missing File", input: "ainaa {\nallowlist /nonexistent/allowlist.txt\n}", shouldErr: true},
+		{name: "Block Response Missing Style", input: "ainaa {\nblock_response\n}", shouldErr: true},
+		{name: "Block Response Status Only", input: "ainaa {\nblock_response 2\n}", shouldErr: true},
+		{name: "Block Response Unknown Style", input: "ainaa {\nblock_response redirect\n}", shouldErr: true},
+		{name: "Block Response Zero Status", input: "ainaa {\nblock_response 0 nodata\n}", shouldErr: true},
+		{name: "Block Response Unexpected Address", input: "ainaa {\nblock_response null 1.2.3.4\n}", shouldErr: true},
+		{name: "Block Response Sinkhole Missing Address", input: "ainaa {\nblock_response sinkhole\n}", shouldErr: true},
+		{name: "Block Response Sinkhole Invalid Address", input: "ainaa {\nblock_response sinkhole blockpage\n}", shouldErr: true},
+		{name: "Block Response Sinkhole Two IPv4", input: "ainaa {\nblock_response sinkhole 1.2.3.4 5.6.7.8\n}", shouldErr: true},
+		{name: "EDE Off", input: "ainaa {\nede off\n}", expected: func() *config { c := newConfig(); c.blockEDE = 0; return c }()},
+		{name: "EDE Unknown", input: "ainaa {\nede forbidden\n}", shouldErr: true},
+		{name: "Category Missing Action", input: "ainaa {\ncategory 1 malware\n}", shouldErr: true},
+		{name: "Category Invalid Status", input: "ainaa {\ncategory zero malware block\n}", shouldErr: true},
+		{name: "Category Unknown Action", input: "ainaa {\ncategory 1 malware quarantine\n}", shouldErr: true},
+		{name: "Category Duplicate Name", input: "ainaa {\ncategory 1 malware block\ncategory 2 malware block\n}", shouldErr: true},
+		{name: "Category Allow With Arguments", input: "ainaa {\ncategory 1 news allow nxdomain\n}", shouldErr: true},
+		{name: "Category Redirect Missing Target", input: "ainaa {\ncategory 1 ads redirect\n}", shouldErr: true},
+		{name: "Category Redirect Two Names", input: "ainaa {\ncategory 1 ads redirect a.example b.example\n}", shouldErr: true},
+		{name: "Block Status Unknown Category", input: "ainaa {\nblock_status malware\n}", shouldErr: true},
+		{name: "DynamoDB Profiles Table", input: "ainaa {\ndynamodb profiles Profiles\n}", expected: func() *config { c := newConfig(); c.profilesTable = "Profiles"; return c }()},
+		{name: "Profile Missing Values", input: "ainaa {\nprofile kids networks\n}", shouldErr: true},
+		{name: "Profile Unknown Property", input: "ainaa {\nprofile kids quota 1h\n}", shouldErr: true},
+		{name: "Profile Invalid Network", input: "ainaa {\nprofile kids networks 10.0.0.0/33\n}", shouldErr: true},
+		{name: "Profile Unknown Category", input: "ainaa {\nprofile kids block_categories gaming\n}", shouldErr: true},
+		{name: "Profile Conflicting Categories", input: "ainaa {\ncategory 1 malware block\nprofile kids block_categories malware\nprofile kids allow_categories 1\n}", shouldErr: true},
+		{name: "Profile Invalid Domain", input: "ainaa {\nprofile kids deny bad..domain\n}", shouldErr: true},
+		{name: "Profile Invalid Block Response", input: "ainaa {\nprofile kids block_response sinkhole\n}", shouldErr: true},
+		{name: "Profile Shared Network", input: "ainaa {\nprofile kids networks 10.0.0.0/24\nprofile guests networks 10.0.0.0/24\n}", shouldErr: true},
+		{name: "Client ID", input: "ainaa {\nclient_id edns 65073\nclient_id mac\nclient_id doh\nclient_id sni DNS.example.com.\n}", expected: func() *config {
+			c := newConfig()
+			c.clientIdentifiers = []ClientIdentifier{{Source: "edns", Code: 65073}, {Source: "mac"}, {Source: "doh"}, {Source: "sni", Zone: "dns.example.com"}}
+			return c
+		}()},
+		{name: "Client ID Trusted Forwarders", input: "ainaa {\nclient_id edns 65073 from 10.0.0.0/8 192.0.2.53\nclient_id mac from ::1\n}", expected: func() *config {
+			c := newConfig()
+			c.clientIdentifiers = []ClientIdentifier{
+				{Source: "edns", Code: 65073, From: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.53/32")}},
+				{Source: "mac", From: []netip.Prefix{netip.MustParsePrefix("::1/128")}},
+			}
+			return c
+		}()},
+		{name: "Client ID From Missing Network", input: "ainaa {\nclient_id mac from\n}", shouldErr: true},
+		{name: "Client ID From Invalid Network", input: "ainaa {\nclient_id edns 65073 from 10.0.0.0/33\n}", shouldErr: true},
+		{name: "Client ID DoH From", input: "ainaa {\nclient_id doh from 10.0.0.0/8\n}", shouldErr: true},
+		{name: "Client ID Missing Source", input: "ainaa {\nclient_id\n}", shouldErr: true},
+		{name: "Client ID Unknown Source", input: "ainaa {\nclient_id cookie\n}", shouldErr: true},
+		{name: "Client ID EDNS Missing Code", input: "ainaa {\nclient_id edns\n}", shouldErr: true},
+		{name: "Client ID EDNS Invalid Code", input: "ainaa {\nclient_id edns 70000\n}", shouldErr: true},
+		{name: "Client ID SNI Missing Zone", input: "ainaa {\nclient_id sni\n}", shouldErr: true},
+		{name: "Client ID MAC With Arguments", input: "ainaa {\nclient_id mac 65001\n}", shouldErr: true},
+		{name: "Schedule Missing Values", input: "ainaa {\nschedule nights window\n}", shouldErr: true},
+		{name: "Schedule Unknown Property", input: "ainaa {\nschedule nights hours 8-20\n}", shouldErr: true},
+		{name: "Schedule Unknown Timezone", input: "ainaa {\nschedule nights timezone Mars/Olympus\n}", shouldErr: true},
+		{name: "Schedule Invalid Window", input: "ainaa {\nschedule nights window mon 22:00\n}", shouldErr: true},
+		{name: "Schedule Invalid Exception", input: "ainaa {\nschedule nights window daily 22:00-07:00\nschedule nights except 2026-13-01\n}", shouldErr: true},
+		{name: "Schedule Reversed Exception", input: "ainaa {\nschedule nights window daily 22:00-07:00\nschedule nights except 2027-01-03/2026-12-20\n}", shouldErr: true},
+		{name: "Schedule Without Window", input: "ainaa {\nschedule nights timezone UTC\n}", shouldErr: true},
+		{name: "Profile Unknown Schedule", input: "ainaa {\nprofile kids schedule nights\n}", shouldErr: true},
+		{name: "Profile Two Schedules", input: "ainaa {\nschedule nights window daily 22:00-07:00\nprofile kids schedule nights days\n}", shouldErr: true},
+		{name: "Profile Scheduled Redirect", input: "ainaa {\ncategory 1 ads block\nschedule nights window daily 22:00-07:00\nprofile kids scheduled nights redirect ads\n}", shouldErr: true},
+		{name: "Profile Scheduled Unknown Category", input: "ainaa {\nschedule nights window daily 22:00-07:00\nprofile kids scheduled nights block social\n}", shouldErr: true},
+		{name: "Profile Shared Client", input: "ainaa {\nprofile kids clients tablet\nprofile guests clients tablet\n}", shouldErr: true},
+		{name: "Twice", input: "ainaa\nainaa", shouldErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tt.input)
+			cfg, err := parseConfig(c)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatalf("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, tt.expected) {
+				t.Errorf("Expected config %+v, got %+v", tt.expected, cfg)
+			}
+		})
+	}
+}
+
+func TestParseConfig_AllowlistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.txt")
+	content := "# partners\npartner.com\n\nintranet.example.org. # internal\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("dns", "ainaa {\nallow extra.net\nallowlist "+path+"\n}")
+	cfg, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	expected := DomainList{"extra.net": {}, "partner.com": {}, "intranet.example.org": {}}
+	if !reflect.DeepEqual(cfg.allowlist, expected) {
+		t.Errorf("Expected allowlist %v, got %v", expected, cfg.allowlist)
+	}
+}
+
+func TestParseConfig_Profiles(t *testing.T) {
+	c := caddy.NewTestController("dns", `ainaa {
+		category 2 adult allow
+		category 6 social log
+		profile kids networks 10.0.1.0/24 2001:db8::/64
+		profile kids block_categories adult 6
+		profile kids deny games.example
+		profile kids block_response sinkhole 192.0.2.1
+		profile guests networks 10.0.2.7
+		profile guests allow_categories 1
+		profile guests log_categories social
+		profile guests allow partner.com
+	}`)
+	cfg, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	expected := []*Profile{
+		{
+			Name:          "kids",
+			Networks:      []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24"), netip.MustParsePrefix("2001:db8::/64")},
+			Actions:       map[int]Action{2: ActionBlock, 6: ActionBlock},
+			Allowlist:     DomainList{},
+			Denylist:      DomainList{"games.example": {}},
+			BlockResponse: &BlockResponse{Style: BlockSinkhole, IPs: map[string][]string{"A": {"192.0.2.1"}}},
+		},
+		{
+			Name:      "guests",
+			Networks:  []netip.Prefix{netip.MustParsePrefix("10.0.2.7/32")},
+			Actions:   map[int]Action{1: ActionAllow, 6: ActionLog},
+			Allowlist: DomainList{"partner.com": {}},
+			Denylist:  DomainList{},
+		},
+	}
+	if !reflect.DeepEqual(cfg.profiles, expected) {
+		t.Errorf("Expected profiles %+v, got %+v", expected, cfg.profiles)
+	}
+}
+
+func TestParseConfig_Schedules(t *testing.T) {
+	c := caddy.NewTestController("dns", `ainaa {
+		category 6 social allow
+		schedule school_nights timezone UTC
+		schedule school_nights window sun-thu 22:00-07:00
+		schedule school_nights except 2026-12-22/2027-01-03 2027-04-05
+		schedule weekends window sat,sun 00:00-24:00
+		profile kids networks 10.0.1.0/24
+		profile kids scheduled school_nights block social
+		profile guests networks 10.0.2.0/24
+		profile guests schedule weekends
+	}`)
+	cfg, err := parseConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	nights := cfg.schedules["school_nights"]
+	expected := &Schedule{
+		Name:       "school_nights",
+		Location:   time.UTC,
+		Windows:    []Window{{Days: 0x1f, Start: 22 * 60, End: 7 * 60}},
+		Exceptions: []DateRange{{From: "2026-12-22", To: "2027-01-03"}, {From: "2027-04-05", To: "2027-04-05"}},
+	}
+	if !reflect.DeepEqual(nights, expected) {
+		t.Errorf("Expected schedule %+v, got %+v", expected, nights)
+	}
+	if weekends := cfg.schedules["weekends"]; weekends == nil || weekends.Location != time.Local {
+		t.Errorf("Expected weekends schedule in the local time zone, got %+v", weekends)
+	}
+
+	if len(cfg.profiles) != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", len(cfg.profiles))
+	}
+	kids, guests := cfg.profiles[0], cfg.profiles[1]
+	expectedScheduled := []ScheduledActions{{Schedule: nights, Actions: map[int]Action{6: ActionBlock}}}
+	if !reflect.DeepEqual(kids.Scheduled, expectedScheduled) {
+		t.Errorf("Expected scheduled actions %+v, got %+v", expectedScheduled, kids.Scheduled)
+	}
+	if guests.Schedule != cfg.schedules["weekends"] {
+		t.Errorf("Expected guests to be scheduled on weekends, got %+v", guests.Schedule)
+	}
+}
@@ -0,0 +1,98 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultStaleWindow is how long expired data is served when serve_stale
+	// is given without a duration.
+	defaultStaleWindow = 1 * time.Hour
+	// staleTTL is the TTL of answers built from stale data, as recommended
+	// by RFC 8767.
+	staleTTL = 30
+)
+
+// isStale reports whether rec expired, serving stale data being enabled.
+func (a Ainaa) isStale(rec CachedDomain) bool {
+	return a.StaleWindow > 0 && rec.Expires != 0 && !a.clock().Before(time.Unix(rec.Expires, 0))
+}
+
+// refresh runs fn in the background, bounded like a query, unless a refresh
+// for key is in progress already. When it fails, the data it refreshes is
+// served as it is.
+func (a Ainaa) refresh(key string, fn func(context.Context) error) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	// The refresh keeps the deadline, not the cancellation, of ctx.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	a.refreshes.try(ctx, key, func(ctx context.Context) (struct{}, error) {
+		err := fn(ctx)
+		if err != nil {
+			log.Debugf("Cannot refresh %s, serving stale data: %v", key, err)
+		}
+		return struct{}{}, err
+	})
+}
+
+// refreshZone replaces the stale record cached for zone with the one stored
+// in DynamoDB, keeping the addresses known to the stale one if it has none.
+func (a Ainaa) refreshZone(ctx context.Context, zone string, stale CachedDomain) error {
+	domainRecord, err := a.Persistent.Get(ctx, zone)
+	if errors.Is(err, ErrDomainNotFound) && stale.Absent {
+		a.store(ctx, zone, stale)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rec := cachedRecord(domainRecord)
+	if rec.IPs == nil {
+		rec.IPs, rec.CNAMEs, rec.IPsExpire = stale.IPs, stale.CNAMEs, stale.IPsExpire
+		rec.Negative = stale.Negative
+	}
+	a.store(ctx, zone, rec)
+	return nil
+}
+
+// refreshAddresses looks up the addresses of domain again and replaces the
+// stale ones cached for it, leaving the decision as it is.
+func (a Ainaa) refreshAddresses(ctx context.Context, domain string) error {
+	res, err := a.resolve(ctx, domain)
+	if err != nil {
+		return err
+	}
+	ttl := res.TTL()
+	if res.Rcode != dns.RcodeSuccess || ttl == 0 {
+		// Better stale addresses than none.
+		return nil
+	}
+	valid := time.Duration(ttl) * time.Second
+	negative := ""
+	if len(res.Records) == 0 {
+		if a.NegativeTTL <= 0 {
+			return nil
+		}
+		negative, valid = negativeNoData, a.negativeTTL(ttl)
+	}
+	rec, err := a.Cache.Get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	now := a.clock()
+	rec.IPs, rec.CNAMEs, rec.Negative = res.IPs(), res.chain(), negative
+	rec.IPsExpire = now.Add(valid).Unix()
+	left := time.Duration(0)
+	if rec.Expires != 0 {
+		left = max(time.Unix(rec.Expires, 0).Sub(now), 0)
+	}
+	return a.Cache.Set(ctx, domain, rec, left+a.StaleWindow)
+}
@@ -0,0 +1,147 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestAinaa_ServeDNSStale(t *testing.T) {
+	now := time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		cached CachedDomain
+		// persistentErr makes DynamoDB fail the refresh.
+		persistentErr bool
+		expectedRcode int
+		expectedIP    string
+		expectedTTL   uint32
+		// expectedRefresh is what the refresh caches, nil if it caches nothing.
+		expectedRefresh *CachedDomain
+	}{
+		{
+			name:            "Fresh",
+			cached:          CachedDomain{Status: 1, Expires: now.Add(time.Minute).Unix()},
+			expectedRcode:   dns.RcodeNameError,
+			expectedRefresh: nil,
+		},
+		{
+			name:            "Stale Record",
+			cached:          CachedDomain{Status: 1, Expires: now.Add(-time.Minute).Unix()},
+			expectedRcode:   dns.RcodeNameError,
+			expectedRefresh: &CachedDomain{Status: 0, Expires: now.Add(time.Hour).Unix()},
+		},
+		{
+			name:          "Stale Record Refresh Failed",
+			cached:        CachedDomain{Status: 1, Expires: now.Add(-time.Minute).Unix()},
+			persistentErr: true,
+			expectedRcode: dns.RcodeNameError,
+		},
+		{
+			name: "Stale Addresses",
+			cached: CachedDomain{
+				IPs:       map[string][]string{"A": {"192.0.2.9"}},
+				IPsExpire: now.Add(-time.Minute).Unix(),
+				Expires:   now.Add(time.Minute).Unix(),
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectedIP:    "192.0.2.9",
+			expectedTTL:   staleTTL,
+			expectedRefresh: &CachedDomain{
+				IPs:       map[string][]string{"A": {"192.0.2.1"}},
+				IPsExpire: now.Add(answerTTL * time.Second).Unix(),
+				Expires:   now.Add(time.Minute).Unix(),
+			},
+		},
+		{
+			name: "Expired Addresses",
+			cached: CachedDomain{
+				IPs:       map[string][]string{"A": {"192.0.2.9"}},
+				IPsExpire: now.Add(-2 * time.Hour).Unix(),
+				Expires:   now.Add(time.Minute).Unix(),
+			},
+			expectedRcode: dns.RcodeSuccess,
+			expectedIP:    "192.0.2.1",
+			expectedTTL:   answerTTL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refreshed := make(chan CachedDomain, 1)
+			a := Ainaa{
+				Cache: &MockCacheRepository{
+					GetFunc: func(ctx context.Context, domain string) (CachedDomain, error) {
+						if domain == "example.com" {
+							return tt.cached, nil
+						}
+						return CachedDomain{}, errors.New("miss")
+					},
+					SetFunc: func(ctx context.Context, domain string, value CachedDomain, ttl time.Duration) error {
+						if !value.Absent {
+							refreshed <- value
+						}
+						return nil
+					},
+				},
+				Persistent: &MockPersistentRepository{
+					GetFunc: func(ctx context.Context, domain string) (DomainRecord, error) {
+						if domain != "example.com" {
+							return DomainRecord{}, ErrDomainNotFound
+						}
+						if tt.persistentErr {
+							return DomainRecord{}, errors.New("unreachable")
+						}
+						return DomainRecord{Domain: domain}, nil
+					},
+				},
+				Resolver: &MockResolver{
+					LookupFunc: func(ctx context.Context, domain string) (map[string][]string, error) {
+						return map[string][]string{"A": {"192.0.2.1"}}, nil
+					},
+				},
+				CacheTTL:    time.Hour,
+				StaleWindow: time.Hour,
+				now:         func() time.Time { return now },
+			}
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := a.ServeDNS(context.TODO(), rec, r); err != nil {
+				t.Fatalf("Expected no errors, but got: %v", err)
+			}
+
+			if rec.Msg.Rcode != tt.expectedRcode {
+				t.Fatalf("Expected Rcode %d, got %d", tt.expectedRcode, rec.Msg.Rcode)
+			}
+			if tt.expectedIP != "" {
+				if len(rec.Msg.Answer) != 1 {
+					t.Fatalf("Expected 1 answer, got %v", rec.Msg.Answer)
+				}
+				if rr := rec.Msg.Answer[0].(*dns.A); rr.A.String() != tt.expectedIP || rr.Hdr.Ttl != tt.expectedTTL {
+					t.Errorf("Expected %s with TTL %d, got %v", tt.expectedIP, tt.expectedTTL, rr)
+				}
+			}
+
+			select {
+			case value := <-refreshed:
+				if tt.expectedRefresh == nil {
+					t.Errorf("Expected nothing cached, got %+v", value)
+				} else if !reflect.DeepEqual(value, *tt.expectedRefresh) {
+					t.Errorf("Expected %+v refreshed, got %+v", *tt.expectedRefresh, value)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.expectedRefresh != nil {
+					t.Errorf("Expected %+v refreshed, got nothing", *tt.expectedRefresh)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package ainaa
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// dohPath is the path of DNS-over-HTTPS upstreams given without one.
+	dohPath = "/dns-query"
+	// doqALPN is the application protocol of DNS-over-QUIC (RFC 9250).
+	doqALPN = "doq"
+	// doqRequestCancelled is the DoQ error code aborting the stream of a
+	// query (RFC 9250, section 4.3).
+	doqRequestCancelled quic.StreamErrorCode = 0x3
+)
+
+// dnsTransport sends DNS messages to a single upstream server.
+type dnsTransport interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	// close closes the connections kept open between queries.
+	close()
+}
+
+// newTransport returns the transport for addr, a host:port address optionally
+// prefixed with tls://, https:// or quic:// and followed by #NAME, the name
+// the server's certificate is checked against and sent as SNI.
+func newTransport(addr string, opts UpstreamOptions) dnsTransport {
+	server, serverName, _ := strings.Cut(addr, "#")
+	trans, host := parse.Transport(server)
+	switch trans {
+	case transport.TLS:
+		return &tlsTransport{addr: host, config: opts.tlsConfig(hostname(host), serverName)}
+	case transport.HTTPS:
+		var ip string
+		if u, err := url.Parse(server); err == nil {
+			ip = u.Hostname()
+		}
+		config := opts.tlsConfig(ip, serverName)
+		return &httpsTransport{
+			url:        server,
+			serverName: serverName,
+			client: &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   config,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   30 * time.Second,
+			}},
+		}
+	case transport.QUIC:
+		config := opts.tlsConfig(hostname(host), serverName)
+		config.NextProtos = []string{doqALPN}
+		return &quicTransport{addr: host, config: config}
+	}
+	return plainTransport(host)
+}
+
+// hostname returns the host of a host:port address.
+func hostname(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// tlsConfig returns the TLS configuration for the server at ip, checked
+// against serverName or else ip, and its pins if it has any.
+func (o UpstreamOptions) tlsConfig(ip, serverName string) *tls.Config {
+	if serverName == "" {
+		serverName = ip
+	}
+	config := &tls.Config{ServerName: serverName, RootCAs: o.RootCAs, MinVersion: tls.VersionTLS12}
+	if pins := o.Pins[serverName]; len(pins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPins(cs, serverName, pins)
+		}
+	}
+	return config
+}
+
+// checkPins accepts a connection whose verified chain holds a certificate
+// whose public key hash is one of pins.
+func checkPins(cs tls.ConnectionState, serverName string, pins []string) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if slices.Contains(pins, pin(cert)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches its pins", serverName)
+}
+
+// pin returns the base64 SHA-256 hash of the public key of cert, as in RFC 7469.
+func pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// plainTransport queries a server over UDP, retrying over TCP when the
+// answer is truncated.
+type plainTransport string
+
+func (t plainTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: "udp"}
+	resp, _, err := client.ExchangeContext(ctx, m, string(t))
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, string(t))
+	}
+	return resp, err
+}
+
+func (t plainTransport) close() {}
+
+const (
+	// tlsIdleTimeout is how long an unused DNS-over-TLS connection is kept
+	// open.
+	tlsIdleTimeout = 10 * time.Second
+	// tlsMaxIdle is how many unused DNS-over-TLS connections are kept open
+	// per server, the others being closed once their query is answered.
+	tlsMaxIdle = 16
+)
+
+// tlsTransport queries a server over DNS-over-TLS (RFC 7858), keeping its
+// connections open between queries.
+type tlsTransport struct {
+	addr   string
+	config *tls.Config
+
+	mu     sync.Mutex
+	idle   []idleConn
+	closed bool
+}
+
+// idleConn is an open connection waiting for a query, along with when it was
+// last used.
+type idleConn struct {
+	conn *dns.Conn
+	used time.Time
+}
+
+func (t *tlsTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: t.config}
+	for {
+		conn := t.take()
+		pooled := conn != nil
+		if !pooled {
+			var err error
+			if conn, err = client.DialContext(ctx, t.addr); err != nil {
+				return nil, err
+			}
+		}
+		resp, _, err := client.ExchangeWithConnContext(ctx, m, conn)
+		if err == nil {
+			t.put(conn)
+			return resp, nil
+		}
+		conn.Close()
+		// The server may have closed the idle connection, try another one.
+		if !pooled || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// take returns the most recently used idle connection, nil if there is none.
+// Connections idle for longer than tlsIdleTimeout are closed.
+func (t *tlsTransport) take() *dns.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Idle connections are ordered by when they were last used.
+	for len(t.idle) > 0 && time.Since(t.idle[0].used) >= tlsIdleTimeout {
+		t.idle[0].conn.Close()
+		t.idle = t.idle[1:]
+	}
+	if len(t.idle) == 0 {
+		return nil
+	}
+	conn := t.idle[len(t.idle)-1].conn
+	t.idle = t.idle[:len(t.idle)-1]
+	return conn
+}
+
+// put returns conn to the idle connections once its query is answered, or
+// closes it if there are enough of them.
+func (t *tlsTransport) put(conn *dns.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || len(t.idle) >= tlsMaxIdle {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, idleConn{conn: conn, used: time.Now()})
+}
+
+// close closes the idle connections, and those still answering a query once
+// they are done.
+func (t *tlsTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.idle {
+		c.conn.Close()
+	}
+	t.idle, t.closed = nil, true
+}
+
+// httpsTransport queries a server over DNS-over-HTTPS (RFC 8484), keeping
+// its connections open between queries.
+type httpsTransport struct {
+	url        string
+	serverName string
+	client     *http.Client
+}
+
+func (t *httpsTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// A zero ID makes the answers cacheable by HTTP caches.
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	if t.serverName != "" {
+		req.Host = t.serverName
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server %s answered %s", t.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+func (t *httpsTransport) close() {
+	t.client.CloseIdleConnections()
+}
+
+// quicTransport queries a server over DNS-over-QUIC (RFC 9250), sending
+// every query on a stream of its own over a shared connection.
+type quicTransport struct {
+	addr   string
+	config *tls.Config
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func (t *quicTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conn, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			t.drop(conn)
+		}
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	// abort cancels both sides of the stream, which would otherwise stay
+	// open on the shared connection.
+	abort := func(err error) (*dns.Msg, error) {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return nil, err
+	}
+
+	// Queries must have a zero ID and are prefixed with their length, like
+	// over TCP.
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return abort(err)
+	}
+	if _, err := stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(buf)))); err != nil {
+		return abort(err)
+	}
+	if _, err := stream.Write(buf); err != nil {
+		return abort(err)
+	}
+	// Closing the stream only ends our side, telling the server the query is complete.
+	stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return abort(err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return abort(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+// connection returns the connection to the server, dialing a new one if there
+// is none or it was closed.
+func (t *quicTransport) connection(ctx context.Context) (*quic.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, t.addr, t.config, &quic.Config{KeepAlivePeriod: 20 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+func (t *quicTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		t.conn.CloseWithError(0, "")
+		t.conn = nil
+	}
+}
+
+// drop closes conn so the next query dials a new connection.
+func (t *quicTransport) drop(conn *quic.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
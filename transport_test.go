@@ -0,0 +1,289 @@
+package ainaa
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// newCertificate returns a self-signed certificate for dns.example and the
+// pool trusting it.
+func newCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{"dns.example"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// answerA answers every query with an A record for 192.0.2.1.
+func answerA(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{test.A(r.Question[0].Name + " 60 IN A 192.0.2.1")}
+	return m
+}
+
+// newDoTServer starts a DNS-over-TLS server and returns its address.
+func newDoTServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerA(r))
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+	return "tls://" + l.Addr().String()
+}
+
+// newDoHServer starts a DNS-over-HTTPS server and returns its URL.
+func newDoHServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r := new(dns.Msg)
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" || r.Unpack(body) != nil || r.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, _ := answerA(r).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buf)
+	}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s.URL + dohPath
+}
+
+// newDoQServer starts a DNS-over-QUIC server and returns its address.
+func newDoQServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var length uint16
+					if binary.Read(stream, binary.BigEndian, &length) != nil {
+						return
+					}
+					buf := make([]byte, length)
+					io.ReadFull(stream, buf)
+					r := new(dns.Msg)
+					if r.Unpack(buf) != nil || r.Id != 0 {
+						stream.CancelWrite(1)
+						continue
+					}
+					resp, _ := answerA(r).Pack()
+					stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+					stream.Close()
+				}
+			}()
+		}
+	}()
+	return "quic://" + l.Addr().String()
+}
+
+func TestTransports(t *testing.T) {
+	cert, pool := newCertificate(t)
+	servers := map[string]string{
+		"DoT": newDoTServer(t, cert),
+		"DoH": newDoHServer(t, cert),
+		"DoQ": newDoQServer(t, cert),
+	}
+	pins := map[string][]string{"dns.example": {pin(cert.Leaf)}}
+	wrongPins := map[string][]string{"dns.example": {"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}
+
+	tests := []struct {
+		name        string
+		serverName  string
+		pins        map[string][]string
+		expectedErr bool
+	}{
+		{name: "Server Name", serverName: "dns.example"},
+		{name: "Pinned", serverName: "dns.example", pins: pins},
+		{name: "Wrong Pin", serverName: "dns.example", pins: wrongPins, expectedErr: true},
+		// The certificate is not valid for the address of the server.
+		{name: "Without Server Name", expectedErr: true},
+	}
+
+	for transport, addr := range servers {
+		for _, tt := range tests {
+			t.Run(transport+" "+tt.name, func(t *testing.T) {
+				server := addr
+				if tt.serverName != "" {
+					server += "#" + tt.serverName
+				}
+				u := NewUpstreams([]string{server}, UpstreamOptions{Pins: tt.pins, RootCAs: pool})
+				res, err := resolve(context.TODO(), u.servers[0], "example.com")
+				if tt.expectedErr {
+					if err == nil {
+						t.Errorf("Expected an error, but got none")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Expected no errors, but got: %v", err)
+				}
+				if expected := map[string][]string{"A": {"192.0.2.1"}}; !reflect.DeepEqual(res.IPs(), expected) {
+					t.Errorf("Expected %v, got %v", expected, res.IPs())
+				}
+			})
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		addr       string
+		expected   string
+		serverName string
+	}{
+		{addr: "192.0.2.53:53", expected: "ainaa.plainTransport"},
+		{addr: "tls://192.0.2.53:853", expected: "*ainaa.tlsTransport", serverName: "192.0.2.53"},
+		{addr: "tls://192.0.2.53:853#dns.example", expected: "*ainaa.tlsTransport", serverName: "dns.example"},
+		{addr: "https://[2001:db8::53]/dns-query", expected: "*ainaa.httpsTransport", serverName: "2001:db8::53"},
+		{addr: "quic://192.0.2.53:853#dns.example", expected: "*ainaa.quicTransport", serverName: "dns.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			tr := newTransport(tt.addr, UpstreamOptions{})
+			if got := reflect.TypeOf(tr).String(); got != tt.expected {
+				t.Fatalf("Expected a %s, got %s", tt.expected, got)
+			}
+			var config *tls.Config
+			switch tr := tr.(type) {
+			case *tlsTransport:
+				config = tr.config
+			case *httpsTransport:
+				config = tr.client.Transport.(*http.Transport).TLSClientConfig
+			case *quicTransport:
+				config = tr.config
+			}
+			if config != nil && config.ServerName != tt.serverName {
+				t.Errorf("Expected server name %q, got %q", tt.serverName, config.ServerName)
+			}
+		})
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestTLSTransportReuse(t *testing.T) {
+	cert, pool := newCertificate(t)
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: tl}
+	s := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerA(r))
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { s.Shutdown() })
+
+	u := NewUpstreams([]string{"tls://" + l.Addr().String() + "#dns.example"}, UpstreamOptions{RootCAs: pool})
+	for _, domain := range []string{"example.com", "example.org", "example.net"} {
+		if _, err := resolve(context.TODO(), u.servers[0], domain); err != nil {
+			t.Fatalf("Expected no errors resolving %s, but got: %v", domain, err)
+		}
+	}
+	if n := l.accepted.Load(); n != 1 {
+		t.Errorf("Expected the queries to share 1 connection, but the server accepted %d", n)
+	}
+}
+
+func TestTLSTransportIdle(t *testing.T) {
+	tr := &tlsTransport{}
+	var servers []net.Conn
+	for range tlsMaxIdle + 1 {
+		client, server := net.Pipe()
+		servers = append(servers, server)
+		tr.put(&dns.Conn{Conn: client})
+	}
+	if len(tr.idle) != tlsMaxIdle {
+		t.Errorf("Expected %d idle connections kept, got %d", tlsMaxIdle, len(tr.idle))
+	}
+	if _, err := servers[tlsMaxIdle].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection beyond the limit closed, got %v", err)
+	}
+
+	tr.close()
+	for i, server := range servers[:tlsMaxIdle] {
+		if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected idle connection %d closed, got %v", i, err)
+		}
+	}
+	client, server := net.Pipe()
+	tr.put(&dns.Conn{Conn: client})
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF || len(tr.idle) != 0 {
+		t.Errorf("Expected connections closed once the transport is, got %v", err)
+	}
+}
@@ -2,9 +2,10 @@ package ainaa
 
 import (
 	"context"
-	"errors"
-	"net"
+	"fmt"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 type DomainRecord struct {
@@ -13,62 +14,109 @@ type DomainRecord struct {
 	CreatedAt time.Time           `json:"createdAt" dynamodbav:"createdAt"`
 	UpdatedAt time.Time           `json:"updatedAt" dynamodbav:"updatedAt"`
 	IPs       map[string][]string `json:"ips" dynamodbav:"ips"`
+	// NoInherit limits a blocking or allowing record to its exact domain
+	// instead of also applying it to every subdomain.
+	NoInherit bool `json:"noInherit" dynamodbav:"noInherit"`
+	// Allow forces the domain to be allowed whatever its status, overriding
+	// the records of its subdomains too unless NoInherit is set.
+	Allow bool `json:"allow" dynamodbav:"allow"`
+	// Source names who made the decision, e.g. "resolver" for records
+	// written after a classification lookup.
+	Source string `json:"source,omitempty" dynamodbav:"source,omitempty"`
+	// Verdicts records what every classification provider said, for records
+	// written after a classification lookup.
+	Verdicts []ProviderVerdict `json:"verdicts,omitempty" dynamodbav:"verdicts,omitempty"`
 }
 
 type CachedDomain struct {
-	Status int                 `json:"status" redis:"status"`
-	IPs    map[string][]string `json:"ips" redis:"ips"`
+	Status    int                 `json:"status" redis:"status"`
+	IPs       map[string][]string `json:"ips" redis:"ips"`
+	NoInherit bool                `json:"noInherit" redis:"noInherit"`
+	Allow     bool                `json:"allow" redis:"allow"`
+	Source    string              `json:"source,omitempty" redis:"source"`
+	// Expires is the Unix time after which the entry is stale, zero if
+	// unknown.
+	Expires int64 `json:"expires,omitempty" redis:"expires"`
+	// CNAMEs are the names the domain is an alias of, known along with IPs.
+	CNAMEs []string `json:"cnames,omitempty" redis:"cnames"`
+	// IPsExpire is the Unix time after which IPs must be looked up again,
+	// zero if they do not expire.
+	IPsExpire int64 `json:"ipsExpire,omitempty" redis:"ipsExpire"`
+	// Negative is set when the upstream gave no addresses for the domain:
+	// "nxdomain" or "servfail" when it could not be classified, "nodata"
+	// when it exists without any. It is valid until IPsExpire.
+	Negative string `json:"negative,omitempty" redis:"negative"`
+	// Absent is set when DynamoDB has no record for the domain, so walks
+	// through it don't ask again.
+	Absent bool `json:"absent,omitempty" redis:"absent"`
+}
+
+// ProfileRecord is a client profile as stored in DynamoDB or written in the Corefile.
+type ProfileRecord struct {
+	Name            string   `json:"name" dynamodbav:"name"`
+	Networks        []string `json:"networks" dynamodbav:"networks"`
+	Clients         []string `json:"clients" dynamodbav:"clients"`
+	BlockCategories []string `json:"blockCategories" dynamodbav:"blockCategories"`
+	AllowCategories []string `json:"allowCategories" dynamodbav:"allowCategories"`
+	LogCategories   []string `json:"logCategories" dynamodbav:"logCategories"`
+	Allow           []string `json:"allow" dynamodbav:"allow"`
+	Deny            []string `json:"deny" dynamodbav:"deny"`
+	// BlockResponse is written like the block_response property, e.g. "sinkhole 192.0.2.1".
+	BlockResponse string `json:"blockResponse" dynamodbav:"blockResponse"`
+	// Schedule names the schedule outside of which the profile is ignored.
+	Schedule string `json:"schedule" dynamodbav:"schedule"`
+	// Scheduled are written like the scheduled property, e.g.
+	// "school_nights block social games".
+	Scheduled []string `json:"scheduled" dynamodbav:"scheduled"`
 }
 
 type Resolver interface {
-	Lookup(domain string) (map[string][]string, error)
+	// Lookup returns the addresses of domain keyed by record type. It gives up
+	// when ctx is done.
+	Lookup(ctx context.Context, domain string) (map[string][]string, error)
 }
 
-type OpenDNSResolver struct{}
+type OpenDNSResolver struct {
+	// Upstreams are the servers raced for every lookup; OpenDNS if nil.
+	Upstreams *Upstreams
+}
 
-func (r *OpenDNSResolver) Lookup(domain string) (map[string][]string, error) {
-	openDNSResolvers := []string{
-		"208.67.222.222:53", // primary
-		"208.67.220.220:53", // secondary
+// Lookup races the upstreams, each for at most 5 seconds, until one answers
+// or ctx is done. A domain that does not exist fails with a not found
+// net.DNSError; one without addresses has none.
+func (r *OpenDNSResolver) Lookup(ctx context.Context, domain string) (map[string][]string, error) {
+	res, err := r.Resolve(ctx, domain)
+	if err != nil {
+		return nil, err
 	}
-	res := make(map[string][]string)
-
-	for _, resolverAddr := range openDNSResolvers {
-		resolver := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{Timeout: 3 * time.Second}
-				return d.DialContext(ctx, network, resolverAddr)
-			},
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		ips, err := resolver.LookupIP(ctx, "ip", domain)
-		cancel()
+	if res.Rcode == dns.RcodeNameError {
+		return nil, errNotFound(domain, "", res.TTL())
+	}
+	return res.IPs(), nil
+}
 
-		if err == nil {
-			for _, ip := range ips {
-				if ip.To4() != nil {
-					res["A"] = append(res["A"], ip.String())
-				} else if ip.To16() != nil {
-					res["AAAA"] = append(res["AAAA"], ip.String())
-				}
-			}
-			return res, nil // success
-		}
+// Resolve is like Lookup but returns the answer as received, with its TTLs,
+// aliases and negative answers.
+func (r *OpenDNSResolver) Resolve(ctx context.Context, domain string) (Resolution, error) {
+	upstreams := r.Upstreams
+	if upstreams == nil {
+		upstreams = NewUpstreams(defaultResolvers, UpstreamOptions{Stagger: defaultStagger})
+	}
+	res, err := race(ctx, upstreams, func(ctx context.Context, s *upstream) (Resolution, error) {
+		return resolve(ctx, s, domain)
+	})
+	if err != nil {
+		return Resolution{}, fmt.Errorf("failed to resolve domain using OpenDNS: %w", err)
 	}
-	return nil, errors.New("failed to resolve domain using OpenDNS")
+	return res, nil
 }
 
+// openDNSBlockPages are the addresses OpenDNS answers blocked domains with.
+var openDNSBlockPages = mustPrefixList(openDNSBlockedIPs...)
+
+// IsBlockedDomain reports whether ips hold the address of an OpenDNS block
+// page, whatever the form it is written in.
 func (r *OpenDNSResolver) IsBlockedDomain(ips map[string][]string) bool {
-	for _, ip := range openDNSBlockedIPs {
-		for _, resolvedIps := range ips {
-			for _, rip := range resolvedIps {
-				if rip == ip {
-					return true
-				}
-			}
-		}
-	}
-	return false
+	_, ok := openDNSBlockPages.MatchIPs(ips)
+	return ok
 }
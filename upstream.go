@@ -0,0 +1,335 @@
+package ainaa
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultStagger is how long an upstream gets to answer before the next
+	// one is queried too, the connection attempt delay of RFC 8305.
+	defaultStagger = 250 * time.Millisecond
+	// failurePenalty is the latency recorded for an upstream that failed.
+	failurePenalty = 5 * time.Second
+
+	// defaultHealthCheck is how often upstreams are probed.
+	defaultHealthCheck = 10 * time.Second
+	// defaultMaxFails is how many consecutive failures mark an upstream down.
+	defaultMaxFails = 3
+)
+
+// ErrUpstreamsDown is returned without querying anything when every upstream
+// is marked down.
+var ErrUpstreamsDown = errors.New("all upstream servers are down")
+
+// exchangeTimeout bounds every exchange with an upstream server.
+const exchangeTimeout = 5 * time.Second
+
+// upstream is a server queries are sent to, along with its measured latency
+// and health.
+type upstream struct {
+	addr      string
+	transport dnsTransport
+	// rtt is the moving average of the upstream's response time in
+	// nanoseconds, zero until it answered once.
+	rtt atomic.Int64
+	// fails counts the consecutive failures of the upstream; down is set
+	// once they reach MaxFails, until a health probe succeeds.
+	fails atomic.Int32
+	down  atomic.Bool
+}
+
+// succeed records that the upstream answered, closing its breaker.
+func (u *upstream) succeed() {
+	u.fails.Store(0)
+	if u.down.CompareAndSwap(true, false) {
+		log.Infof("Upstream %s is back up", u.addr)
+	}
+}
+
+// fail records a failure of the upstream, opening its breaker after maxFails
+// consecutive ones; zero never opens it.
+func (u *upstream) fail(maxFails int) {
+	if n := u.fails.Add(1); maxFails > 0 && int(n) >= maxFails && u.down.CompareAndSwap(false, true) {
+		log.Warningf("Upstream %s is down after %d consecutive failures", u.addr, n)
+	}
+}
+
+// query sends a query for the qtype records of domain to the upstream.
+func (u *upstream) query(ctx context.Context, domain string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+	return u.transport.exchange(ctx, m)
+}
+
+// observe adds a response time to the moving average of the upstream.
+func (u *upstream) observe(d time.Duration) {
+	for {
+		old := u.rtt.Load()
+		rtt := int64(d)
+		if old != 0 {
+			rtt = (7*old + 3*int64(d)) / 10
+		}
+		if u.rtt.CompareAndSwap(old, rtt) {
+			return
+		}
+	}
+}
+
+// Upstreams is a set of servers raced against each other, the fastest first.
+// Servers failing MaxFails times in a row are marked down and skipped until
+// a health probe succeeds.
+type Upstreams struct {
+	// Stagger is how long to wait for an answer before also querying the next
+	// server; zero queries all servers at once.
+	Stagger time.Duration
+	// MaxFails is how many consecutive failures mark a server down; zero
+	// never marks servers down.
+	MaxFails int
+	servers  []*upstream
+}
+
+// UpstreamOptions configures how upstream servers are queried.
+type UpstreamOptions struct {
+	// Stagger and MaxFails are those of Upstreams.
+	Stagger  time.Duration
+	MaxFails int
+	// Pins maps server names to the base64 SHA-256 hashes of public keys,
+	// one of which the certificate chain of the server must hold.
+	Pins map[string][]string
+	// RootCAs verifies the certificates of encrypted upstreams, the system
+	// roots if nil.
+	RootCAs *x509.CertPool
+}
+
+// NewUpstreams returns the upstreams for addrs, host:port addresses
+// optionally prefixed with the transport and followed by the server name, as
+// in tls://192.0.2.53:853#dns.example.
+func NewUpstreams(addrs []string, opts UpstreamOptions) *Upstreams {
+	u := &Upstreams{Stagger: opts.Stagger, MaxFails: opts.MaxFails}
+	for _, addr := range addrs {
+		u.servers = append(u.servers, &upstream{addr: addr, transport: newTransport(addr, opts)})
+	}
+	return u
+}
+
+// Close closes the connections kept open to the upstreams.
+func (u *Upstreams) Close() {
+	for _, s := range u.servers {
+		s.transport.close()
+	}
+}
+
+// Addrs returns the addresses of the upstreams in the order they were configured.
+func (u *Upstreams) Addrs() []string {
+	var addrs []string
+	for _, s := range u.servers {
+		addrs = append(addrs, s.addr)
+	}
+	return addrs
+}
+
+// RTT returns the average response time of the upstream at addr, zero if it
+// never answered.
+func (u *Upstreams) RTT(addr string) time.Duration {
+	for _, s := range u.servers {
+		if s.addr == addr {
+			return time.Duration(s.rtt.Load())
+		}
+	}
+	return 0
+}
+
+// Down reports whether the upstream at addr is marked down.
+func (u *Upstreams) Down(addr string) bool {
+	for _, s := range u.servers {
+		if s.addr == addr {
+			return s.down.Load()
+		}
+	}
+	return false
+}
+
+// ordered returns the upstreams that are not down, fastest first. Upstreams
+// that never answered come first so they get measured.
+func (u *Upstreams) ordered() []*upstream {
+	var servers []*upstream
+	for _, s := range u.servers {
+		if !s.down.Load() {
+			servers = append(servers, s)
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].rtt.Load() < servers[j].rtt.Load()
+	})
+	return servers
+}
+
+// answered reports whether err is an answer rather than a failure: no error,
+// or a name that does not exist.
+func answered(err error) bool {
+	return err == nil || notFound(err)
+}
+
+// responded reports whether the upstream behind err is up: it answered, if
+// only to fail the lookup with an rcode such as SERVFAIL.
+func responded(err error) bool {
+	var rcodeErr *rcodeError
+	return answered(err) || errors.As(err, &rcodeErr)
+}
+
+// rcodeError is a well-formed answer of an upstream failing or refusing a
+// lookup, such as SERVFAIL for a lame domain. It says nothing against the
+// upstream itself.
+type rcodeError struct {
+	*net.DNSError
+	Rcode int
+}
+
+func (e *rcodeError) Unwrap() error { return e.DNSError }
+
+// errRcode returns the error of a lookup of domain server answered with rcode.
+func errRcode(domain, server string, rcode int) error {
+	return &rcodeError{
+		DNSError: &net.DNSError{Err: "server answered " + dns.RcodeToString[rcode], Name: domain, Server: server},
+		Rcode:    rcode,
+	}
+}
+
+// notFound reports whether err says a name does not exist.
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// race queries the upstreams with try, fastest first, starting the next one
+// after u.Stagger or as soon as one fails. The first answer wins and the
+// queries still running are cancelled; if all fail, the last error is
+// returned. Only upstreams that did not respond at all count as failing, an
+// upstream answering SERVFAIL is up.
+func race[T any](ctx context.Context, u *Upstreams, try func(ctx context.Context, s *upstream) (T, error)) (T, error) {
+	var zero T
+	if len(u.servers) == 0 {
+		return zero, fmt.Errorf("no upstream servers")
+	}
+	servers := u.ordered()
+	if len(servers) == 0 {
+		return zero, ErrUpstreamsDown
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	results := make(chan result, len(servers))
+	next := 0
+	start := func() {
+		s := servers[next]
+		next++
+		go func() {
+			begin := time.Now()
+			v, err := try(ctx, s)
+			switch {
+			case responded(err):
+				s.observe(time.Since(begin))
+				s.succeed()
+				upstreamDuration.WithLabelValues(s.addr).Observe(time.Since(begin).Seconds())
+			case ctx.Err() == nil:
+				// Only blame the upstream if it was not cancelled.
+				s.observe(failurePenalty)
+				s.fail(u.MaxFails)
+			}
+			results <- result{v, err}
+		}()
+	}
+
+	var stagger <-chan time.Time
+	if u.Stagger > 0 {
+		ticker := time.NewTicker(u.Stagger)
+		defer ticker.Stop()
+		stagger = ticker.C
+		start()
+	} else {
+		for next < len(servers) {
+			start()
+		}
+	}
+
+	var lastErr error
+	for pending := next; pending > 0; {
+		select {
+		case r := <-results:
+			pending--
+			if answered(r.err) {
+				return r.v, r.err
+			}
+			lastErr = r.err
+			if next < len(servers) {
+				start()
+				pending++
+			}
+		case <-stagger:
+			if next < len(servers) {
+				start()
+				pending++
+			}
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+	return zero, lastErr
+}
+
+// healthCheck probes every upstream each interval until stop is closed. A
+// successful probe brings a server marked down back up, a failed one counts
+// as a failure.
+func (u *Upstreams) healthCheck(interval time.Duration, probe func(ctx context.Context, s *upstream) error, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, s := range u.servers {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				err := probe(ctx, s)
+				cancel()
+				if !responded(err) {
+					log.Debugf("Health probe of upstream %s failed: %v", s.addr, err)
+					s.fail(u.MaxFails)
+					continue
+				}
+				s.succeed()
+			}
+		}
+	}
+}
+
+// probeDNS checks that the upstream answers a query for the root name servers.
+func probeDNS(ctx context.Context, s *upstream) error {
+	resp, err := s.query(ctx, ".", dns.TypeNS)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return errRcode(".", s.addr, resp.Rcode)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package ainaa
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRace(t *testing.T) {
+	delays := map[string]time.Duration{
+		"slow:53": 200 * time.Millisecond,
+		"fast:53": 10 * time.Millisecond,
+	}
+	u := NewUpstreams([]string{"slow:53", "fast:53"}, UpstreamOptions{})
+
+	try := func(ctx context.Context, s *upstream) (string, error) {
+		select {
+		case <-time.After(delays[s.addr]):
+			return s.addr, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	got, err := race(context.TODO(), u, try)
+	if err != nil || got != "fast:53" {
+		t.Fatalf("Expected the fastest upstream to win, got %q, %v", got, err)
+	}
+	if rtt := u.RTT("fast:53"); rtt == 0 {
+		t.Errorf("Expected the latency of the winner to be recorded")
+	}
+	if rtt := u.RTT("slow:53"); rtt != 0 {
+		t.Errorf("Expected the cancelled upstream not to be blamed, got latency %s", rtt)
+	}
+	if order := u.ordered(); order[0].addr != "slow:53" {
+		t.Errorf("Expected the unmeasured upstream first, got %s", order[0].addr)
+	}
+
+	// Once both are measured, the fastest is queried first and the slow one
+	// is only started if the fast one does not answer within the stagger.
+	u.servers[0].observe(delays["slow:53"])
+	u.Stagger = 100 * time.Millisecond
+	var mu sync.Mutex
+	var tried []string
+	got, err = race(context.TODO(), u, func(ctx context.Context, s *upstream) (string, error) {
+		mu.Lock()
+		tried = append(tried, s.addr)
+		mu.Unlock()
+		return try(ctx, s)
+	})
+	if err != nil || got != "fast:53" {
+		t.Fatalf("Expected the fastest upstream to win, got %q, %v", got, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tried) != 1 || tried[0] != "fast:53" {
+		t.Errorf("Expected only the fastest upstream to be queried, got %v", tried)
+	}
+}
+
+func TestRace_Failures(t *testing.T) {
+	u := NewUpstreams([]string{"a:53", "b:53", "c:53"}, UpstreamOptions{Stagger: time.Hour})
+	failure := errors.New("refused")
+
+	// A failure starts the next upstream at once, without waiting for the stagger.
+	got, err := race(context.TODO(), u, func(ctx context.Context, s *upstream) (string, error) {
+		if s.addr == "c:53" {
+			return s.addr, nil
+		}
+		return "", failure
+	})
+	if err != nil || got != "c:53" {
+		t.Fatalf("Expected the only working upstream to answer, got %q, %v", got, err)
+	}
+	if rtt := u.RTT("a:53"); rtt != failurePenalty {
+		t.Errorf("Expected the failing upstream to be penalized, got latency %s", rtt)
+	}
+	if order := u.ordered(); order[0].addr != "c:53" {
+		t.Errorf("Expected the working upstream first, got %s", order[0].addr)
+	}
+
+	// A name that does not exist is an answer.
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	if _, err := race(context.TODO(), u, func(ctx context.Context, s *upstream) (string, error) {
+		return "", notFound
+	}); err != notFound {
+		t.Errorf("Expected the not found error, got %v", err)
+	}
+
+	if _, err := race(context.TODO(), u, func(ctx context.Context, s *upstream) (string, error) {
+		return "", failure
+	}); err != failure {
+		t.Errorf("Expected the last error, got %v", err)
+	}
+
+	if _, err := race(context.TODO(), NewUpstreams(nil, UpstreamOptions{}), func(ctx context.Context, s *upstream) (string, error) {
+		return s.addr, nil
+	}); err == nil {
+		t.Errorf("Expected an error without upstreams, but got none")
+	}
+}
+
+func TestUpstreams_Breaker(t *testing.T) {
+	u := NewUpstreams([]string{"a:53", "b:53"}, UpstreamOptions{})
+	u.MaxFails = 2
+	failure := errors.New("refused")
+	failing := func(ctx context.Context, s *upstream) (string, error) {
+		if s.addr == "b:53" {
+			// Answer after the other upstream failed, so it is blamed.
+			time.Sleep(20 * time.Millisecond)
+			return s.addr, nil
+		}
+		return "", failure
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := race(context.TODO(), u, failing); err != nil {
+			t.Fatalf("Expected the working upstream to answer, got %v", err)
+		}
+	}
+	if !u.Down("a:53") || u.Down("b:53") {
+		t.Fatalf("Expected only the failing upstream down, got a %t, b %t", u.Down("a:53"), u.Down("b:53"))
+	}
+
+	// An answer resets the count of failures.
+	u.servers[1].fail(u.MaxFails)
+	if _, err := race(context.TODO(), u, failing); err != nil {
+		t.Fatalf("Expected the working upstream to answer, got %v", err)
+	}
+	u.servers[1].fail(u.MaxFails)
+	if u.Down("b:53") {
+		t.Errorf("Expected failures to be counted from the last answer")
+	}
+
+	// Once every upstream is down, nothing is queried.
+	u.servers[1].fail(u.MaxFails)
+	if _, err := race(context.TODO(), u, func(ctx context.Context, s *upstream) (string, error) {
+		t.Errorf("Unexpected query to %s", s.addr)
+		return s.addr, nil
+	}); !errors.Is(err, ErrUpstreamsDown) {
+		t.Errorf("Expected ErrUpstreamsDown, got %v", err)
+	}
+
+	// A successful probe brings an upstream back.
+	stop := make(chan struct{})
+	defer close(stop)
+	go u.healthCheck(10*time.Millisecond, func(ctx context.Context, s *upstream) error {
+		if s.addr == "a:53" {
+			return failure
+		}
+		return nil
+	}, stop)
+	deadline := time.Now().Add(time.Second)
+	for u.Down("b:53") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if u.Down("b:53") || !u.Down("a:53") {
+		t.Errorf("Expected only the probed upstream back up, got a %t, b %t", u.Down("a:53"), u.Down("b:53"))
+	}
+}
+
+func TestUpstreams_BreakerServfail(t *testing.T) {
+	s := newUpstream(t, func(q dns.Question) (int, []dns.RR, []dns.RR) {
+		return dns.RcodeServerFailure, nil, nil
+	})
+	u := NewUpstreams([]string{s.Addr}, UpstreamOptions{MaxFails: 2})
+	r := &OpenDNSResolver{Upstreams: u}
+
+	// A lame domain fails its lookups, the upstream answering them is up.
+	for i := 0; i < 3; i++ {
+		if _, err := r.Resolve(context.TODO(), "lame.example.com"); err == nil || errors.Is(err, ErrUpstreamsDown) {
+			t.Fatalf("Expected the SERVFAIL of the upstream, got %v", err)
+		}
+	}
+	if u.Down(s.Addr) {
+		t.Errorf("Expected the upstream answering SERVFAIL to stay up")
+	}
+	if u.RTT(s.Addr) == failurePenalty {
+		t.Errorf("Expected the response time of the upstream recorded, got the failure penalty")
+	}
+}
@@ -0,0 +1,105 @@
+package ainaa
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+)
+
+// Sources a verdict can come from.
+const (
+	// sourceAllowlist is the allowlist configured in the Corefile.
+	sourceAllowlist = "allowlist"
+	// sourcePersistent is a record stored in DynamoDB without a source of its own.
+	sourcePersistent = "dynamodb"
+	// sourceResolver is a classification lookup through the resolver.
+	sourceResolver = "resolver"
+	// sourceDenylist is the deny list of the client's profile.
+	sourceDenylist = "denylist"
+	// sourceDegraded is the degraded mode applied while every upstream is down.
+	sourceDegraded = "degraded"
+	// sourceIPBlocklist is the IP blocklist matching an address of the domain.
+	sourceIPBlocklist = "ipblocklist"
+)
+
+// verdict is the block/allow decision for a queried domain.
+type verdict struct {
+	// zone is the name the decision was made for, the queried domain or one of its parents.
+	zone   string
+	status int
+	// ips are the addresses known for the queried domain, if any, valid
+	// until expires unless it is zero, and cnames the aliases leading to them.
+	ips     map[string][]string
+	cnames  []string
+	expires time.Time
+	source  string
+	// denied is set when the domain is blocked whatever its status.
+	denied bool
+	// stale is set when the decision expired and is being refreshed.
+	stale bool
+	// negative is the negative state of the queried domain, valid until
+	// expires like its addresses.
+	negative string
+}
+
+// newVerdict builds the verdict for domain from the record stored for zone.
+func newVerdict(domain, zone string, rec CachedDomain) verdict {
+	v := verdict{zone: zone, status: rec.Status, source: rec.Source}
+	if v.source == "" {
+		v.source = sourcePersistent
+	}
+	// Addresses of a parent domain say nothing about its subdomains.
+	if zone == domain {
+		v.ips, v.cnames, v.negative = rec.IPs, rec.CNAMEs, rec.Negative
+		if v.negative == negativeNoData && v.ips == nil {
+			// Known to have no addresses, rather than not known to have any.
+			v.ips = map[string][]string{}
+		}
+		if rec.IPsExpire != 0 {
+			v.expires = time.Unix(rec.IPsExpire, 0)
+		}
+	}
+	return v
+}
+
+// addresses returns the addresses of the verdict still valid at t and the TTL
+// to answer with, what is left of theirs or answerTTL if they do not expire.
+func (v verdict) addresses(t time.Time) (map[string][]string, uint32) {
+	if v.expires.IsZero() {
+		return v.ips, answerTTL
+	}
+	left := v.expires.Sub(t)
+	if left < time.Second {
+		return nil, 0
+	}
+	return v.ips, uint32(left / time.Second)
+}
+
+// setMetadata exposes the verdict to other plugins, such as log, when the
+// metadata plugin is enabled.
+func setMetadata(ctx context.Context, v verdict) {
+	metadata.SetValueFunc(ctx, name+"/source", func() string { return v.source })
+	metadata.SetValueFunc(ctx, name+"/zone", func() string { return v.zone })
+	metadata.SetValueFunc(ctx, name+"/status", func() string { return strconv.Itoa(v.status) })
+}
+
+// setCategoryMetadata exposes the category of the verdict and its action.
+func setCategoryMetadata(ctx context.Context, cat Category) {
+	metadata.SetValueFunc(ctx, name+"/category", func() string { return cat.Name })
+	metadata.SetValueFunc(ctx, name+"/action", func() string { return cat.Action.String() })
+}
+
+// setClientMetadata exposes the identity of the client and the name of its
+// profile.
+func setClientMetadata(ctx context.Context, client Client, profile *Profile) {
+	metadata.SetValueFunc(ctx, name+"/client", client.String)
+	metadata.SetValueFunc(ctx, name+"/client_source", func() string { return client.Source })
+	metadata.SetValueFunc(ctx, name+"/profile", func() string {
+		if profile == nil {
+			return ""
+		}
+		return profile.Name
+	})
+}